@@ -0,0 +1,468 @@
+package car
+
+/*
+The access.go lets a buyer or an insurer ask the owner for access to the
+reports of a car on the ledger. The requester spawns an AccessRequest from
+its own darc, with the spawn:accessRequest rule that only the darcs of
+SpawnRequesterDarc have, naming the car, the scope and the reason. The
+request is stored under the car darc and listed in the PendingRequests of
+the owner, so the owner finds it without knowing the requester. A requester
+has at most one pending request for a car, and an owner at most
+maxPendingRequests. The owner then invokes approveAccess or denyAccess on it: the
+approval of ScopeReports stores a ReadGrant for the requester darc, and the
+approval of a field adds the requester darc to the rule of its
+FieldReadCommand.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/protobuf"
+)
+
+// ContractAccessRequestID is the contract of the access requests.
+var ContractAccessRequestID = "accessRequest"
+
+// ContractPendingRequestsID is the contract of the lists of pending
+// requests of the owners, they are only created by the access request
+// contract.
+var ContractPendingRequestsID = "pendingRequests"
+
+// ScopeReports is the scope of an access request for all the reports, the
+// other scopes are the SecretFields.
+const ScopeReports = "reports"
+
+// The states of an access request.
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestDenied   = "denied"
+)
+
+// maxReasonLength is the longest reason an access request can give
+const maxReasonLength = 256
+
+// maxPendingRequests is the largest number of requests waiting for an owner
+const maxPendingRequests = 100
+
+// PendingRequestsID returns the ID of the list of the pending requests of
+// the owner identity.
+func PendingRequestsID(owner string) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractPendingRequestsID))
+	h.Write([]byte(owner))
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// ValidateScope returns an error if the scope is neither ScopeReports nor
+// one of the SecretFields.
+func ValidateScope(scope string) error {
+	if scope == ScopeReports {
+		return nil
+	}
+	if _, ok := fieldOfCommand(FieldReadCommand(scope)); !ok {
+		return errors.New("the scope must be the reports or one of their fields")
+	}
+	return nil
+}
+
+// ContractAccessRequest spawns the AccessRequest in the "request" argument
+// from the darc of the requester. The request can then be invoked with
+// approveAccess, and the "expiry" of the grant for ScopeReports, or with
+// denyAccess, following the rules of the car darc.
+func ContractAccessRequest(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	cIn []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+
+	cOut = cIn
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		scs, err = spawnAccessRequest(cdb, inst)
+		return
+	case byzcoin.InvokeType:
+		var request AccessRequest
+		var requestBuf []byte
+		var darcID darc.ID
+		requestBuf, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return
+		}
+		err = protobuf.Decode(requestBuf, &request)
+		if err != nil {
+			return
+		}
+		if request.Status != RequestPending {
+			return nil, nil, errors.New("the request is already " + request.Status)
+		}
+		switch inst.Invoke.Command {
+		case "approveAccess":
+			scs, err = request.approve(cdb, inst.Invoke.Args)
+			request.Status = RequestApproved
+		case "denyAccess":
+			request.Status = RequestDenied
+		default:
+			err = errors.New("access requests can only be approved or denied")
+		}
+		if err != nil {
+			return
+		}
+		var sc byzcoin.StateChange
+		sc, err = removePending(cdb, request.Owner, inst.InstanceID)
+		if err != nil {
+			return
+		}
+		scs = append(scs, sc)
+		requestBuf, err = protobuf.Encode(&request)
+		if err != nil {
+			return
+		}
+		scs = append(scs, byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+			ContractAccessRequestID, requestBuf, darcID))
+		return
+	default:
+		return nil, nil, errors.New("access requests can't be deleted")
+	}
+}
+
+// spawnAccessRequest stores the request under the car darc, so that the
+// owner can approve it, and adds it to the pending requests of the owner
+func spawnAccessRequest(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) ([]byzcoin.StateChange, error) {
+	if inst.Spawn.ContractID != ContractAccessRequestID {
+		return nil, errors.New("can only spawn access requests")
+	}
+	var request AccessRequest
+	err := protobuf.Decode(inst.Spawn.Args.Search("request"), &request)
+	if err != nil {
+		return nil, errors.New("not an access request")
+	}
+	err = ValidateScope(request.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Reason) > maxReasonLength {
+		return nil, errors.New("the reason is too long")
+	}
+	carBuf, contractID, carDarcID, err := cdb.GetValues(request.CarInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if contractID != ContractCarID {
+		return nil, errors.New("the request must be for a car")
+	}
+	var car Car
+	err = protobuf.Decode(carBuf, &car)
+	if err != nil {
+		return nil, err
+	}
+	if car.Owner == "" {
+		return nil, errors.New("the car has no owner to approve the request")
+	}
+	request.Requester = darc.NewIdentityDarc(inst.InstanceID.Slice()).String()
+	request.Status = RequestPending
+	request.Owner = car.Owner
+	request.Expiry = 0
+	requestBuf, err := protobuf.Encode(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	requestID := inst.DeriveID("")
+	pendingID := PendingRequestsID(car.Owner)
+	var pending PendingRequests
+	action := byzcoin.Create
+	//the list keeps the darc it was created with
+	pendingDarcID := carDarcID
+	pendingBuf, _, listDarcID, errPending := cdb.GetValues(pendingID.Slice())
+	if errPending == nil {
+		action = byzcoin.Update
+		pendingDarcID = listDarcID
+		err = protobuf.Decode(pendingBuf, &pending)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = pending.verifyNew(cdb, request)
+	if err != nil {
+		return nil, err
+	}
+	pending.RequestIDs = append(pending.RequestIDs, requestID.Slice())
+	pendingBuf, err = protobuf.Encode(&pending)
+	if err != nil {
+		return nil, err
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, requestID, ContractAccessRequestID, requestBuf, carDarcID),
+		byzcoin.NewStateChange(action, pendingID, ContractPendingRequestsID, pendingBuf, pendingDarcID),
+	}, nil
+}
+
+// verifyNew returns an error if the owner already has maxPendingRequests
+// pending requests, or if the requester already has a pending request for
+// the car of the request
+func (pending *PendingRequests) verifyNew(cdb byzcoin.ReadOnlyStateTrie, request AccessRequest) error {
+	if len(pending.RequestIDs) >= maxPendingRequests {
+		return errors.New("the owner has too many pending requests")
+	}
+	for _, id := range pending.RequestIDs {
+		buf, _, _, err := cdb.GetValues(id)
+		if err != nil {
+			return err
+		}
+		var other AccessRequest
+		err = protobuf.Decode(buf, &other)
+		if err != nil {
+			return err
+		}
+		if other.Requester == request.Requester && bytes.Equal(other.CarInstanceID, request.CarInstanceID) {
+			return errors.New("the requester already has a pending request for the car")
+		}
+	}
+	return nil
+}
+
+// approve grants the access of the request to its requester, if the car
+// still has the owner the request was made to
+func (request *AccessRequest) approve(cdb byzcoin.ReadOnlyStateTrie,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	carID := byzcoin.NewInstanceID(request.CarInstanceID)
+	carBuf, _, carDarcID, err := cdb.GetValues(carID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	var car Car
+	err = protobuf.Decode(carBuf, &car)
+	if err != nil {
+		return nil, err
+	}
+	if car.Owner != request.Owner {
+		return nil, errors.New("the car changed owner since the request was made")
+	}
+
+	if request.Scope == ScopeReports {
+		if err = car.verifyStatus("grantRead"); err != nil {
+			return nil, err
+		}
+		expiryBuf := args.Search("expiry")
+		if len(expiryBuf) != 8 {
+			return nil, errors.New("need the expiry of the read grant")
+		}
+		request.Expiry = int64(binary.LittleEndian.Uint64(expiryBuf))
+		grantBuf, err := protobuf.Encode(&ReadGrant{
+			Reader: request.Requester,
+			Expiry: request.Expiry,
+		})
+		if err != nil {
+			return nil, err
+		}
+		scs, err := car.GrantRead(cdb, carID, carDarcID, byzcoin.Arguments{{Name: "grant", Value: grantBuf}})
+		if err != nil {
+			return nil, err
+		}
+		//the car keeps the reader of the grant
+		carBuf, err = protobuf.Encode(&car)
+		if err != nil {
+			return nil, err
+		}
+		return append(scs, byzcoin.NewStateChange(byzcoin.Update, carID, ContractCarID, carBuf, carDarcID)), nil
+	}
+
+	//adding the requester to the darcs which can read the field
+	if err = car.verifyStatus("discloseField"); err != nil {
+		return nil, err
+	}
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return nil, err
+	}
+	action := darc.Action("invoke:" + FieldReadCommand(request.Scope))
+	readers := carDarc.Rules.Get(action)
+	if readers == nil {
+		readers = carDarc.Rules.Get("spawn:calypsoRead")
+	}
+	return evolveRule(carDarc, action,
+		expression.InitOrExpr("("+string(readers)+")", request.Requester))
+}
+
+// removePending returns the state change removing the request from the
+// pending requests of the owner
+func removePending(cdb byzcoin.ReadOnlyStateTrie, owner string,
+	requestID byzcoin.InstanceID) (byzcoin.StateChange, error) {
+
+	pendingID := PendingRequestsID(owner)
+	pendingBuf, _, darcID, err := cdb.GetValues(pendingID.Slice())
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	var pending PendingRequests
+	err = protobuf.Decode(pendingBuf, &pending)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	var left PendingRequests
+	for _, id := range pending.RequestIDs {
+		if !requestID.Equal(byzcoin.NewInstanceID(id)) {
+			left.RequestIDs = append(left.RequestIDs, id)
+		}
+	}
+	pendingBuf, err = protobuf.Encode(&left)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	return byzcoin.NewStateChange(byzcoin.Update, pendingID, ContractPendingRequestsID,
+		pendingBuf, darcID), nil
+}
+
+// SpawnRequesterDarc returns a transaction spawning the darc of a buyer or
+// an insurer from an existing control darc, which can ask the owners of cars
+// for access to their reports as well as do everything a darc of SpawnDarc
+// does.
+func SpawnRequesterDarc(controlDarc *darc.Darc, idString string,
+	role string) (byzcoin.ClientTransaction, *darc.Darc, error) {
+
+	var ctx byzcoin.ClientTransaction
+	rs := darc.NewRules()
+	for _, action := range []darc.Action{"invoke:evolve", "_sign", "spawn:accessRequest"} {
+		if err := rs.AddRule(action, expression.InitAndExpr(idString)); err != nil {
+			panic("add rule should never fail on an empty rule list: " + err.Error())
+		}
+	}
+	newDarc := darc.NewDarc(rs, []byte(role+" darc"))
+	newDarcBuf, err := newDarc.ToProto()
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx = newSpawnDarcTransaction(controlDarc, newDarcBuf)
+
+	return ctx, newDarc, err
+}
+
+// RequestAccess asks the owner of the car for access to the scope, either
+// ScopeReports or one of the SecretFields, and returns the ID of the
+// request. The signers must fulfil the spawn:accessRequest rule of the
+// requester darc, spawned with SpawnRequesterDarc, which becomes the reader
+// once the request is approved. A requester can't ask again for a car while
+// its request is pending.
+func (c *Client) RequestAccess(requesterDarc *darc.Darc, carID byzcoin.InstanceID,
+	scope string, reason string, signers ...darc.Signer) (byzcoin.InstanceID, error) {
+
+	requestBuf, err := protobuf.Encode(&AccessRequest{
+		CarInstanceID: carID.Slice(),
+		Scope:         scope,
+		Reason:        reason,
+	})
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: byzcoin.NewInstanceID(requesterDarc.GetBaseID()),
+			Nonce:      byzcoin.GenNonce(),
+			Index:      0,
+			Length:     1,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractAccessRequestID,
+				Args:       byzcoin.Arguments{{Name: "request", Value: requestBuf}},
+			},
+		}},
+	}
+	err = ctx.Instructions[0].SignBy(requesterDarc.GetBaseID(), signers...)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	return ctx.Instructions[0].DeriveID(""), nil
+}
+
+// ApproveAccess approves the request, the reads of ScopeReports are granted
+// until expiry. The signers must fulfil the invoke:approveAccess rule of the
+// car darc.
+func (c *Client) ApproveAccess(requestID byzcoin.InstanceID, controlDarc *darc.Darc,
+	expiry time.Time, signers ...darc.Signer) error {
+
+	expiryBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expiryBuf, uint64(expiry.Unix()))
+	return c.sendAccessCommand(requestID, controlDarc, "approveAccess",
+		byzcoin.Arguments{{Name: "expiry", Value: expiryBuf}}, signers)
+}
+
+// DenyAccess denies the request. The signers must fulfil the
+// invoke:denyAccess rule of the car darc.
+func (c *Client) DenyAccess(requestID byzcoin.InstanceID, controlDarc *darc.Darc,
+	signers ...darc.Signer) error {
+
+	return c.sendAccessCommand(requestID, controlDarc, "denyAccess", nil, signers)
+}
+
+// GetAccessRequest returns the access request.
+func (c *Client) GetAccessRequest(requestID byzcoin.InstanceID) (*AccessRequest, error) {
+	var request AccessRequest
+	err := c.getInstance(requestID, ContractAccessRequestID, &request)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// GetPendingRequests returns the IDs of the access requests waiting for the
+// owner identity, and the requests themselves.
+func (c *Client) GetPendingRequests(owner string) ([]byzcoin.InstanceID, []AccessRequest, error) {
+	var pending PendingRequests
+	err := c.getInstance(PendingRequestsID(owner), ContractPendingRequestsID, &pending)
+	if err == errInstanceNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []byzcoin.InstanceID
+	var requests []AccessRequest
+	for _, id := range pending.RequestIDs {
+		request, err := c.GetAccessRequest(byzcoin.NewInstanceID(id))
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, byzcoin.NewInstanceID(id))
+		requests = append(requests, *request)
+	}
+	return ids, requests, nil
+}
+
+// sendAccessCommand sends the instruction invoking the command on the access
+// request, signed with the car darc
+func (c *Client) sendAccessCommand(requestID byzcoin.InstanceID, controlDarc *darc.Darc,
+	command string, args byzcoin.Arguments, signers []darc.Signer) error {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: requestID,
+			Nonce:      byzcoin.Nonce{},
+			Index:      0,
+			Length:     1,
+			Invoke: &byzcoin.Invoke{
+				Command: command,
+				Args:    args,
+			},
+		}},
+	}
+	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
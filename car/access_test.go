@@ -0,0 +1,21 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateScope(t *testing.T) {
+	require.Nil(t, ValidateScope(ScopeReports))
+	for _, field := range SecretFields {
+		require.Nil(t, ValidateScope(field))
+	}
+	require.NotNil(t, ValidateScope(""))
+	require.NotNil(t, ValidateScope("owner"))
+}
+
+func TestPendingRequestsID(t *testing.T) {
+	require.Equal(t, PendingRequestsID("darc:1234"), PendingRequestsID("darc:1234"))
+	require.NotEqual(t, PendingRequestsID("darc:1234"), PendingRequestsID("darc:5678"))
+}
@@ -0,0 +1,317 @@
+package car
+
+/*
+The amend.go lets the garage of a report, or the admin of the car, correct or
+retract the report. The reports are never changed: the amendments and the
+retractions are appended to the reports, which are the audit trail, and link
+to the original report by index and hash. EffectiveReports returns the
+history where the original reports are replaced by their last amendment and
+the retracted ones are left out.
+*/
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/protobuf"
+)
+
+// Hash returns the hash of the encoded report, used to link amendments and
+// retractions to it.
+func (r *Report) Hash() ([]byte, error) {
+	buf, err := protobuf.Encode(r)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(buf)
+	return h[:], nil
+}
+
+// Amend appends the amendment or the retraction in the "report" argument to
+// the reports and updates the state of the original report. The original
+// report must not be retracted yet and the amendment must be signed by a
+// member of the garage of the original report or of the admin darc of the
+// car. The writes of an amendment are checked like the ones of a new report.
+// An amendment can't change the mileage of the report.
+func (car *Car) Amend(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID, carDarcID darc.ID,
+	args byzcoin.Arguments, signatures []darc.Signature, retraction bool) ([]byzcoin.StateChange, error) {
+
+	var r Report
+	err := protobuf.Decode(args.Search("report"), &r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Amends == nil || r.Retraction != retraction {
+		return nil, errors.New("need an amendment or a retraction of a report")
+	}
+	original, state, exists, err := car.amendedReport(cdb, carID, *r.Amends)
+	if err != nil {
+		return nil, err
+	}
+	if r.GarageId != original.GarageId {
+		return nil, errors.New("an amendment keeps the garage of the report")
+	}
+	if string(r.RecallID) != string(original.RecallID) {
+		return nil, errors.New("an amendment keeps the recall closed by the report")
+	}
+	if retraction {
+		r.Kind = original.Kind
+	} else {
+		err = ValidateReportKind(r.Kind)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.RecallID) > 0 && r.Kind != ReportRecall {
+			return nil, errors.New("the amendment of a recall report stays a recall report")
+		}
+		if string(r.MileageCommitment) != string(original.MileageCommitment) {
+			return nil, errors.New("an amendment can't change the mileage, retract the report instead")
+		}
+	}
+	err = validateWrites(r)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyWrites(cdb, carDarcID, r)
+	if err != nil {
+		return nil, err
+	}
+	err = car.verifyTimestamp(r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	err = verifyAmender(cdb, carDarcID, r, signatures)
+	if err != nil {
+		return nil, err
+	}
+
+	if retraction {
+		state.Retracted = true
+		//the mileage of the next report is checked against the last report
+		//which is still in the effective history
+		car.MileageCommitment, err = car.lastMileage(cdb, carID, r.Amends.Index)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		state.Amended = true
+		state.Amendment = car.ReportCount
+	}
+	sc, err := car.newReportStateChange(carID, r, carDarcID)
+	if err != nil {
+		return nil, err
+	}
+	stateBuf, err := protobuf.Encode(state)
+	if err != nil {
+		return nil, err
+	}
+	action := byzcoin.Create
+	if exists {
+		action = byzcoin.Update
+	}
+	return []byzcoin.StateChange{sc,
+		byzcoin.NewStateChange(action, ReportStateID(carID, r.Amends.Index),
+			ContractReportStateID, stateBuf, carDarcID),
+	}, nil
+}
+
+// amendedReport returns the original report the reference points to, with
+// its state and whether the state is already stored
+func (car *Car) amendedReport(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID,
+	ref ReportRef) (*Report, *ReportState, bool, error) {
+
+	if ref.Index >= car.ReportCount {
+		return nil, nil, false, errors.New("no report with this index")
+	}
+	original, err := loadReport(cdb, carID, ref.Index)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if original.Amends != nil {
+		return nil, nil, false, errors.New("only original reports can be amended")
+	}
+	hash, err := original.Hash()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if string(hash) != string(ref.Hash) {
+		return nil, nil, false, errors.New("the hash doesn't match the report")
+	}
+	state, exists, err := loadReportState(cdb, carID, ref.Index)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if state.Retracted {
+		return nil, nil, false, errors.New("the report is retracted")
+	}
+	return original, state, exists, nil
+}
+
+// lastMileage returns the mileage commitment of the last original report
+// which is not retracted, without the report at index retracted
+func (car *Car) lastMileage(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID,
+	retracted uint32) ([]byte, error) {
+
+	for i := int64(car.ReportCount) - 1; i >= 0; i-- {
+		if uint32(i) == retracted {
+			continue
+		}
+		r, err := loadReport(cdb, carID, uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		if r.Amends != nil {
+			continue
+		}
+		state, _, err := loadReportState(cdb, carID, uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		if !state.Retracted {
+			return r.MileageCommitment, nil
+		}
+	}
+	return nil, nil
+}
+
+// verifyAmender checks that SignedBy signed the instruction and is a member
+// of the admin darc of the car or of the garage of the report, which must
+// then be certified at the time of the amendment.
+func verifyAmender(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID, r Report,
+	signatures []darc.Signature) error {
+
+	signed := false
+	for _, sig := range signatures {
+		if sig.Signer.String() == r.SignedBy {
+			signed = true
+		}
+	}
+	if !signed {
+		return errors.New("the amendment must be signed by the signer in SignedBy")
+	}
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return err
+	}
+	getDarc := darcGetter(cdb)
+	if darc.EvalExpr(carDarc.Rules.Get("spawn:car"), getDarc, r.SignedBy) == nil {
+		return nil
+	}
+	if darc.EvalExpr([]byte(r.GarageId), getDarc, r.SignedBy) == nil {
+		return verifyCertified(cdb, r)
+	}
+	return errors.New("only the garage of the report or the admin can amend it")
+}
+
+// AmendReport replaces the secret of the report at index by wData. original
+// is the secret of the report, the mileage of wData must be the same. The
+// signers must fulfil the invoke:amendReport rule of the car darc and
+// signerG must be a member of the garage of the report or of the admin darc.
+func (c *Client) AmendReport(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	index uint32, wData SecretData, original *SecretData, note string,
+	signerG darc.Signer, signerO darc.Signer) error {
+
+	if wData.MileageKm() != original.MileageKm() {
+		return errors.New("an amendment can't change the mileage, retract the report instead")
+	}
+	wData.MileageBlinding = original.MileageBlinding
+	amendment, err := c.newAmendment(instID, index, signerG)
+	if err != nil {
+		return err
+	}
+	key := random.Bits(128, true, random.New())
+	_, wInstance, err := c.AddWrite(key, wData, controlDarc, signerG, signerO)
+	if err != nil {
+		return err
+	}
+	amendment.WriteInstanceID = wInstance.Slice()
+	amendment.Kind = wData.Kind
+	amendment.Note = note
+	return c.sendReportCommand(instID, "amendReport", *amendment, controlDarc, signerG, signerO)
+}
+
+// RetractReport retracts the report at index, so that it's no longer part of
+// the effective history. The signers must fulfil the invoke:retractReport
+// rule of the car darc and signer must be a member of the garage of the
+// report or of the admin darc.
+func (c *Client) RetractReport(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	index uint32, note string, signer darc.Signer, signers ...darc.Signer) error {
+
+	retraction, err := c.newAmendment(instID, index, signer)
+	if err != nil {
+		return err
+	}
+	retraction.Retraction = true
+	retraction.Note = note
+	return c.sendReportCommand(instID, "retractReport", *retraction, controlDarc,
+		append([]darc.Signer{signer}, signers...)...)
+}
+
+// ReadHistory returns the page of the audit trail of the car from index from
+// to from+count-1, with the amendments and the retractions, and the
+// decrypted secrets of the effective history of its original reports. Only
+// the reports of the page, and the last amendments of its original reports,
+// are read.
+func (c *Client) ReadHistory(instID byzcoin.InstanceID, from, count uint32, controlDarc *darc.Darc,
+	signerR darc.Signer, signerO darc.Signer) ([]SecretData, []Report, error) {
+
+	trail, err := c.GetReportsPage(instID, from, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	effective, err := effectivePage(instID, from, trail, c.getInstance)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets, err := c.readReports(effective, controlDarc, signerR, signerO)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secrets, trail, nil
+}
+
+// newAmendment returns a report linked to the report at index
+func (c *Client) newAmendment(instID byzcoin.InstanceID, index uint32,
+	signer darc.Signer) (*Report, error) {
+
+	original, err := c.GetReport(instID, index)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := original.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return &Report{
+		Timestamp:         time.Now().UnixNano(),
+		GarageId:          original.GarageId,
+		SignedBy:          signer.Identity().String(),
+		MileageCommitment: original.MileageCommitment,
+		Amends:            &ReportRef{Index: index, Hash: hash},
+		RecallID:          original.RecallID,
+	}, nil
+}
+
+// sendReportCommand sends the instruction invoking the command with the
+// report on the car instance
+func (c *Client) sendReportCommand(instID byzcoin.InstanceID, command string,
+	report Report, controlDarc *darc.Darc, signers ...darc.Signer) error {
+
+	instr, err := newReportCommand(instID, command, report)
+	if err != nil {
+		return err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{instr},
+	}
+	err = ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
@@ -0,0 +1,261 @@
+package car
+
+/*
+The audit.go lets the owner see who read the history of the car. A secret
+is read by spawning a Calypso read instance for its write instance, either
+directly with spawn:calypsoRead, with the read of a grant or with the
+FieldReadCommand of a field. These instructions are not kept in the state
+of the ledger, so the audit trail is found by going through the blocks and
+keeping the accepted instructions reading one of the write instances of the
+reports of the car.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// ReadAccess is a read instance spawned for a write instance of a report of
+// the car, as found in the blocks of the ledger.
+type ReadAccess struct {
+	// ReadInstanceID is the ID of the Calypso read instance
+	ReadInstanceID byzcoin.InstanceID
+	// WriteInstanceID is the ID of the write instance read
+	WriteInstanceID []byte
+	// ReportIndex is the index of the report whose secret is read
+	ReportIndex uint32
+	// Field is the group of fields read, or empty if the whole secret is read
+	Field string
+	// Action is the action of the instruction spawning the read, like
+	// spawn:calypsoRead, invoke:read for a grant or invoke:readMileage
+	Action string
+	// Readers are the identities which signed the instruction
+	Readers []string
+	// Xc is the key the secret is re-encrypted to
+	Xc kyber.Point
+	// BlockIndex is the index of the block holding the instruction
+	BlockIndex int
+	// Timestamp is the time of the block, in nanoseconds since the Unix epoch
+	Timestamp int64
+}
+
+// reportWrite is the report, and the field of the report, of a write
+// instance
+type reportWrite struct {
+	index uint32
+	field string
+}
+
+// reportWrites returns the write instances of the reports of the trail
+func reportWrites(trail []Report) map[string]reportWrite {
+	writes := map[string]reportWrite{}
+	for i, r := range trail {
+		if len(r.WriteInstanceID) > 0 {
+			writes[string(r.WriteInstanceID)] = reportWrite{index: uint32(i)}
+		}
+		for _, fw := range r.FieldWrites {
+			writes[string(fw.WriteInstanceID)] = reportWrite{index: uint32(i), field: fw.Field}
+		}
+	}
+	return writes
+}
+
+// readAccessesInBlock returns the accesses in the accepted transactions of
+// the block which could read a write of the car, without their report
+func readAccessesInBlock(sb *skipchain.SkipBlock, carID byzcoin.InstanceID,
+	grants map[string]bool) ([]ReadAccess, error) {
+
+	var header byzcoin.DataHeader
+	err := protobuf.Decode(sb.Data, &header)
+	if err != nil {
+		return nil, errors.New("not a byzcoin block: " + err.Error())
+	}
+	var body byzcoin.DataBody
+	err = protobuf.Decode(sb.Payload, &body)
+	if err != nil {
+		return nil, errors.New("not a byzcoin block: " + err.Error())
+	}
+	var accesses []ReadAccess
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		for _, instr := range tx.ClientTransaction.Instructions {
+			if !spawnsCarRead(instr, carID, grants) {
+				continue
+			}
+			var read calypso.Read
+			err = protobuf.DecodeWithConstructors(readArgs(instr).Search("read"), &read,
+				network.DefaultConstructors(cothority.Suite))
+			if err != nil {
+				continue
+			}
+			access := ReadAccess{
+				ReadInstanceID:  instr.DeriveID(""),
+				WriteInstanceID: read.Write.Slice(),
+				Action:          instr.Action(),
+				Xc:              read.Xc,
+				BlockIndex:      sb.Index,
+				Timestamp:       header.Timestamp,
+			}
+			for _, sig := range instr.Signatures {
+				access.Readers = append(access.Readers, sig.Signer.String())
+			}
+			accesses = append(accesses, access)
+		}
+	}
+	return accesses, nil
+}
+
+// grantIDs returns the IDs of all the read grants given for the car
+func grantIDs(carID byzcoin.InstanceID, car *Car) map[string]bool {
+	grants := map[string]bool{}
+	for _, reader := range car.GrantReaders {
+		grants[string(ReadGrantID(carID, reader).Slice())] = true
+	}
+	return grants
+}
+
+// spawnsCarRead returns true if the instruction spawns a Calypso read
+// instance, which could read a write of the car: directly, with one of the
+// grants of the car or with the FieldReadCommand of the car
+func spawnsCarRead(instr byzcoin.Instruction, carID byzcoin.InstanceID, grants map[string]bool) bool {
+	switch {
+	case instr.Spawn != nil:
+		return instr.Spawn.ContractID == calypso.ContractReadID
+	case instr.Invoke == nil:
+		return false
+	case instr.Invoke.Command == "read":
+		return grants[string(instr.InstanceID.Slice())]
+	default:
+		_, ok := fieldOfCommand(instr.Invoke.Command)
+		return ok && instr.InstanceID.Equal(carID)
+	}
+}
+
+// readArgs returns the arguments of the spawn or invoke instruction
+func readArgs(instr byzcoin.Instruction) byzcoin.Arguments {
+	if instr.Spawn != nil {
+		return instr.Spawn.Args
+	}
+	return instr.Invoke.Args
+}
+
+// GetReadAccesses returns every read instance spawned for the write
+// instances of the reports of the car in the blocks from the index from to
+// the latest block, in the order of the ledger, with the identities which
+// signed it, the report read and the time of its block. It also returns the
+// index of the block to start from the next time, so that the owner doesn't
+// go through all the blocks of the ledger again. The reports of the car are
+// only read until the reports of all the accessed writes are found.
+func (c *Client) GetReadAccesses(instID byzcoin.InstanceID, from int) ([]ReadAccess, int, error) {
+	if from < 0 {
+		return nil, 0, errors.New("the index of the block can't be negative")
+	}
+	resp, err := c.ByzCoin.GetProof(instID.Slice())
+	if err != nil {
+		return nil, 0, err
+	}
+	var carData Car
+	err = decodeInstance(&resp.Proof, instID, ContractCarID, &carData)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, _, _, carDarcID, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sc := skipchain.NewClient()
+	chain, err := sc.GetUpdateChain(&c.ByzCoin.Roster, c.ByzCoin.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(chain.Update) == 0 {
+		return nil, 0, errors.New("got an empty chain")
+	}
+	latest := chain.Update[len(chain.Update)-1].Index
+	grants := grantIDs(instID, &carData)
+	var found []ReadAccess
+	for i := from; i <= latest; i++ {
+		sb, err := sc.GetSingleBlockByIndex(&c.ByzCoin.Roster, c.ByzCoin.ID, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		inBlock, err := readAccessesInBlock(sb, instID, grants)
+		if err != nil {
+			return nil, 0, err
+		}
+		found = append(found, inBlock...)
+	}
+
+	writes, err := c.accessedWrites(instID, carData.ReportCount, carDarcID, found)
+	if err != nil {
+		return nil, 0, err
+	}
+	var accesses []ReadAccess
+	for _, access := range found {
+		w, ok := writes[string(access.WriteInstanceID)]
+		if !ok {
+			continue
+		}
+		access.ReportIndex = w.index
+		access.Field = w.field
+		accesses = append(accesses, access)
+	}
+	return accesses, latest + 1, nil
+}
+
+// accessedWrites returns the reports of the writes of the accesses which are
+// Calypso writes of the car darc. The reports of the car are read by pages,
+// until the reports of all these writes are found.
+func (c *Client) accessedWrites(carID byzcoin.InstanceID, reportCount uint32, carDarcID darc.ID,
+	accesses []ReadAccess) (map[string]reportWrite, error) {
+
+	wanted := map[string]bool{}
+	checked := map[string]bool{}
+	for _, access := range accesses {
+		id := string(access.WriteInstanceID)
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+		resp, err := c.ByzCoin.GetProof(access.WriteInstanceID)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Proof.InclusionProof.Match(access.WriteInstanceID) {
+			continue
+		}
+		_, _, contractID, writeDarcID, err := resp.Proof.KeyValue()
+		if err != nil {
+			return nil, err
+		}
+		if contractID == calypso.ContractWriteID && writeDarcID.Equal(carDarcID) {
+			wanted[id] = true
+		}
+	}
+
+	writes := map[string]reportWrite{}
+	for from := uint32(0); from < reportCount && len(writes) < len(wanted); from += MaxReportsPage {
+		page, err := reportsPage(carID, reportCount, from, MaxReportsPage, c.getInstance)
+		if err != nil {
+			return nil, err
+		}
+		for id, w := range reportWrites(page) {
+			if wanted[id] {
+				w.index += from
+				writes[id] = w
+			}
+		}
+	}
+	return writes, nil
+}
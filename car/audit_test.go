@@ -0,0 +1,59 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportWrites(t *testing.T) {
+	trail := []Report{
+		{WriteInstanceID: []byte("write 0")},
+		{FieldWrites: []FieldWrite{
+			{Field: FieldMileage, WriteInstanceID: []byte("write 1 mileage")},
+			{Field: FieldNotes, WriteInstanceID: []byte("write 1 notes")},
+		}},
+	}
+	writes := reportWrites(trail)
+	require.Equal(t, 3, len(writes))
+	require.Equal(t, reportWrite{index: 0}, writes["write 0"])
+	require.Equal(t, reportWrite{index: 1, field: FieldNotes}, writes["write 1 notes"])
+}
+
+func TestSpawnsCarRead(t *testing.T) {
+	carID := byzcoin.NewInstanceID([]byte("car"))
+	reader := darc.NewSignerEd25519(nil, nil)
+	signatures := []darc.Signature{{Signer: reader.Identity()}}
+	//the grants of the car, to a key and to a darc the reader is in
+	grants := grantIDs(carID, &Car{GrantReaders: []string{"ed25519:reader", "darc:buyer"}})
+	require.Equal(t, 2, len(grants))
+
+	spawn := byzcoin.Instruction{Spawn: &byzcoin.Spawn{ContractID: calypso.ContractReadID}}
+	require.True(t, spawnsCarRead(spawn, carID, grants))
+	spawn.Spawn.ContractID = ContractCarID
+	require.False(t, spawnsCarRead(spawn, carID, grants))
+
+	//the reads of the grants of the car, whoever signed them
+	grantRead := byzcoin.Instruction{
+		InstanceID: ReadGrantID(carID, "ed25519:reader"),
+		Invoke:     &byzcoin.Invoke{Command: "read"},
+		Signatures: signatures,
+	}
+	require.True(t, spawnsCarRead(grantRead, carID, grants))
+	grantRead.InstanceID = ReadGrantID(carID, "darc:buyer")
+	require.True(t, spawnsCarRead(grantRead, carID, grants))
+	grantRead.InstanceID = ReadGrantID(byzcoin.NewInstanceID([]byte("other car")), "darc:buyer")
+	require.False(t, spawnsCarRead(grantRead, carID, grants))
+
+	//the reads of the fields of the car
+	fieldRead := byzcoin.Instruction{
+		InstanceID: carID,
+		Invoke:     &byzcoin.Invoke{Command: FieldReadCommand(FieldMileage)},
+	}
+	require.True(t, spawnsCarRead(fieldRead, carID, grants))
+	fieldRead.Invoke.Command = "addReport"
+	require.False(t, spawnsCarRead(fieldRead, carID, grants))
+}
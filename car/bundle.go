@@ -0,0 +1,277 @@
+package car
+
+/*
+The bundle.go exports the history of a car to a file that a buyer can keep
+and check later, without trusting the conodes it was exported from. The
+HistoryBundle holds the Car, all its reports and the secrets of the
+effective history decrypted by the exporter, with the ByzCoin proofs of the
+car, the report and the write instances. Every proof holds the forward links
+from the genesis block to the block it was taken from, collectively signed
+by the conodes, so VerifyHistoryBundle only needs the ID of the genesis
+block. The symmetric keys of the writes are in the bundle too, so that the
+data of the proven writes is decrypted again to check the secrets.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// HistoryBundle is the history of a car with the proofs needed to verify it
+// offline.
+type HistoryBundle struct {
+	CarInstanceID []byte
+	Car           Car
+	CarProof      byzcoin.Proof
+	// Reports are all the reports of the car, with the amendments and the
+	// retractions, and ReportProofs their proofs in the same order
+	Reports      []Report
+	ReportProofs []byzcoin.Proof
+	// Secrets are the decrypted secrets of the reports of the effective
+	// history
+	Secrets []BundleSecret
+}
+
+// BundleSecret is the decrypted secret of a report of the bundle.
+type BundleSecret struct {
+	// ReportIndex is the index of the report in the reports of the car
+	ReportIndex uint32
+	Secret      SecretData
+	// Writes are the write instances of the report, the one of its
+	// WriteInstanceID or the ones of its FieldWrites in the same order
+	Writes []BundleWrite
+}
+
+// BundleWrite is a Calypso write instance of a report with its symmetric
+// key, decrypted by the exporter of the bundle.
+type BundleWrite struct {
+	Proof byzcoin.Proof
+	Key   []byte
+}
+
+// EncodeHistoryBundle encodes the bundle, to be written to a file.
+func EncodeHistoryBundle(b *HistoryBundle) ([]byte, error) {
+	return protobuf.Encode(b)
+}
+
+// DecodeHistoryBundle decodes the bundle, without verifying it.
+func DecodeHistoryBundle(buf []byte) (*HistoryBundle, error) {
+	var b HistoryBundle
+	err := protobuf.DecodeWithConstructors(buf, &b, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("not a history bundle: " + err.Error())
+	}
+	return &b, nil
+}
+
+// VerifyHistoryBundle decodes the bundle and verifies it against the ID of
+// the genesis block of the ledger. The returned bundle can then be trusted.
+func VerifyHistoryBundle(buf []byte, genesisID skipchain.SkipBlockID) (*HistoryBundle, error) {
+	b, err := DecodeHistoryBundle(buf)
+	if err != nil {
+		return nil, err
+	}
+	err = b.Verify(genesisID)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Verify checks, without contacting the conodes, that all the proofs of the
+// bundle go back to the genesis block, that the Car and the reports are the
+// ones of the proofs and that every secret is the one of the proven writes
+// of a report of the effective history.
+func (b *HistoryBundle) Verify(genesisID skipchain.SkipBlockID) error {
+	carID := byzcoin.NewInstanceID(b.CarInstanceID)
+	var car Car
+	err := verifyInstance(&b.CarProof, genesisID, carID, ContractCarID, &car)
+	if err != nil {
+		return errors.New("wrong proof of the car: " + err.Error())
+	}
+	if !sameEncoding(&car, &b.Car) {
+		return errors.New("the car is not the one of the proof")
+	}
+	if len(b.Reports) != int(car.ReportCount) || len(b.ReportProofs) != len(b.Reports) {
+		return errors.New("the bundle must have all the reports of the car")
+	}
+	for i := range b.Reports {
+		var r Report
+		err = verifyInstance(&b.ReportProofs[i], genesisID, ReportInstanceID(carID, uint32(i)),
+			ContractReportID, &r)
+		if err != nil {
+			return fmt.Errorf("wrong proof of the report %d: %v", i, err)
+		}
+		if !sameEncoding(&r, &b.Reports[i]) {
+			return fmt.Errorf("the report %d is not the one of the proof", i)
+		}
+	}
+
+	effective := map[uint32]bool{}
+	for _, index := range effectiveIndexes(b.Reports) {
+		effective[index] = true
+	}
+	for _, s := range b.Secrets {
+		if !effective[s.ReportIndex] {
+			return fmt.Errorf("the report %d is not in the effective history", s.ReportIndex)
+		}
+		report := b.Reports[s.ReportIndex]
+		writeIDs := reportWriteIDs([]Report{report})
+		if len(s.Writes) != len(writeIDs) {
+			return fmt.Errorf("the bundle must have all the writes of the report %d", s.ReportIndex)
+		}
+		var plainTexts [][]byte
+		for j, w := range s.Writes {
+			plainText, err := verifyWrite(&w, genesisID, writeIDs[j])
+			if err != nil {
+				return fmt.Errorf("wrong write of the report %d: %v", s.ReportIndex, err)
+			}
+			plainTexts = append(plainTexts, plainText)
+		}
+		secrets, err := decodeSecrets([]Report{report}, plainTexts)
+		if err != nil {
+			return err
+		}
+		if !sameEncoding(&secrets[0], &s.Secret) {
+			return fmt.Errorf("the secret of the report %d is not the one of its writes", s.ReportIndex)
+		}
+	}
+	return nil
+}
+
+// verifyInstance verifies the proof against the genesis block and decodes
+// the value of the instance, which must be of the given contract
+func verifyInstance(pr *byzcoin.Proof, genesisID skipchain.SkipBlockID, id byzcoin.InstanceID,
+	contractID string, value interface{}) error {
+
+	err := pr.Verify(genesisID)
+	if err != nil {
+		return err
+	}
+	err = decodeInstance(pr, id, contractID, value)
+	if err == errInstanceNotFound {
+		return errors.New("the proof is not for the instance")
+	}
+	return err
+}
+
+// verifyWrite verifies the proof of the write instance against the genesis
+// block and returns its data decrypted with the key of the write
+func verifyWrite(w *BundleWrite, genesisID skipchain.SkipBlockID, writeID []byte) ([]byte, error) {
+	err := w.Proof.Verify(genesisID)
+	if err != nil {
+		return nil, err
+	}
+	if !w.Proof.InclusionProof.Match(writeID) {
+		return nil, errors.New("the proof is not for the write instance")
+	}
+	_, _, contractID, _, err := w.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if contractID != calypso.ContractWriteID {
+		return nil, errors.New("not a write instance")
+	}
+	return decryptData(&w.Proof, w.Key)
+}
+
+// sameEncoding returns true if both values have the same protobuf encoding
+func sameEncoding(a interface{}, b interface{}) bool {
+	bufA, errA := protobuf.Encode(a)
+	bufB, errB := protobuf.Encode(b)
+	return errA == nil && errB == nil && bytes.Equal(bufA, bufB)
+}
+
+// ExportHistory returns the bundle of the history of the car, where the
+// secrets of the effective history are read like with ReadReports.
+func (c *Client) ExportHistory(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	signerR darc.Signer, signerO darc.Signer) (*HistoryBundle, error) {
+
+	return c.exportHistory(instID, signerR, func(writeIDs [][]byte) ([]byzcoin.InstanceID, error) {
+		return c.addReads(writeIDs, controlDarc, signerR, signerO)
+	})
+}
+
+// ExportHistoryWithGrant returns the bundle of the history of the car, where
+// the secrets of the effective history are read like with
+// ReadReportsWithGrant.
+func (c *Client) ExportHistoryWithGrant(instID byzcoin.InstanceID, reader darc.Identity,
+	signers ...darc.Signer) (*HistoryBundle, error) {
+
+	signerR, spawnReads, err := c.grantReads(instID, reader, signers)
+	if err != nil {
+		return nil, err
+	}
+	return c.exportHistory(instID, signerR, spawnReads)
+}
+
+// exportHistory gets the proofs of the car and of all its reports and
+// decrypts the writes of the effective history with the reader
+func (c *Client) exportHistory(instID byzcoin.InstanceID, reader darc.Signer,
+	spawnReads func(writeIDs [][]byte) ([]byzcoin.InstanceID, error)) (*HistoryBundle, error) {
+
+	b := &HistoryBundle{CarInstanceID: instID.Slice()}
+	resp, err := c.ByzCoin.GetProof(instID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	b.CarProof = resp.Proof
+	err = decodeInstance(&b.CarProof, instID, ContractCarID, &b.Car)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < b.Car.ReportCount; i++ {
+		id := ReportInstanceID(instID, i)
+		resp, err := c.ByzCoin.GetProof(id.Slice())
+		if err != nil {
+			return nil, err
+		}
+		var r Report
+		err = decodeInstance(&resp.Proof, id, ContractReportID, &r)
+		if err != nil {
+			return nil, err
+		}
+		b.Reports = append(b.Reports, r)
+		b.ReportProofs = append(b.ReportProofs, resp.Proof)
+	}
+
+	indexes := effectiveIndexes(b.Reports)
+	if len(indexes) == 0 {
+		return b, nil
+	}
+	reports := make([]Report, len(indexes))
+	for i, index := range indexes {
+		reports[i] = b.Reports[index]
+	}
+	writes, err := c.readWrites(reports, reader, spawnReads)
+	if err != nil {
+		return nil, err
+	}
+	plainTexts := make([][]byte, len(writes))
+	for i, w := range writes {
+		plainTexts[i] = w.data
+	}
+	secrets, err := decodeSecrets(reports, plainTexts)
+	if err != nil {
+		return nil, err
+	}
+	next := 0
+	for i, index := range indexes {
+		s := BundleSecret{ReportIndex: index, Secret: secrets[i]}
+		for range reportWriteIDs(reports[i : i+1]) {
+			s.Writes = append(s.Writes, BundleWrite{Proof: *writes[next].proof, Key: writes[next].key})
+			next++
+		}
+		b.Secrets = append(b.Secrets, s)
+	}
+	return b, nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/calypso"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
@@ -16,37 +17,30 @@ import (
 	"time"
 )
 
+// NewCar returns an active Car with the normalized VIN and no reports
 func NewCar(VIN string) (Car) {
 	var c Car
-	c.Vin = VIN
-	c.Reports = []Report{}
+	c.Vin = NormalizeVin(VIN)
+	c.Status = StatusActive
 	return c
 }
 
-//creating transaction with spawn:car instruction
-func (s *ser) createCarInstance(car Car,
+// CreateCarInstance sends a transaction with a spawn:car instruction and
+// returns the ID of the new car instance
+func (c *Client) CreateCarInstance(car Car,
 	controlDarc *darc.Darc, signer darc.Signer) (byzcoin.InstanceID, error) {
 
 	var instID byzcoin.InstanceID
-	carBuf, err := protobuf.Encode(&car)
+	instr, err := newCarInstruction(car, controlDarc.GetBaseID())
 	if err != nil {
 		return instID, err
 	}
 	ctx := byzcoin.ClientTransaction{
-		Instructions: []byzcoin.Instruction{{
-			InstanceID: byzcoin.NewInstanceID(controlDarc.GetBaseID()),
-			Nonce:      byzcoin.Nonce{},
-			Index:      0,
-			Length:     1,
-			Spawn: &byzcoin.Spawn{
-				ContractID: ContractCarID,
-				Args:       byzcoin.Arguments{{Name: "car", Value: carBuf}},
-			},
-		}},
+		Instructions: []byzcoin.Instruction{instr},
 	}
 
 	// Sending this transaction to ByzCoin
-	_, err = s.signAndSendTransaction(ctx, signer, controlDarc, ctx.Instructions[0].DeriveID("").Slice())
+	_, err = c.SignAndSendTransaction(ctx, signer, controlDarc, ctx.Instructions[0].DeriveID("").Slice())
 	if err != nil {
 		return instID, err
 	}
@@ -54,40 +48,59 @@ func (s *ser) createCarInstance(car Car,
 	return ctx.Instructions[0].DeriveID(""), err
 }
 
+// AddReport encrypts wData in a new Calypso write instance and adds a report
+// pointing to it to the car instance. previous is the secret of the last
+// report of the car, needed to prove that the mileage didn't go down, or nil
+// for the first report.
+func (c *Client) AddReport(instID byzcoin.InstanceID,
+	controlDarc *darc.Darc, wData SecretData, previous *SecretData,
+	signerG darc.Signer, signerO darc.Signer) error{
 
-func (s *ser) addReport(instID byzcoin.InstanceID,
-	controlDarc *darc.Darc, wData SecretData, signerG darc.Signer, signerO darc.Signer) error{
+	return c.addReport(instID, controlDarc, wData, previous, nil, signerG, signerO)
+}
+
+// addReport adds the report of wData to the car, closing the recall if
+// recallID is not nil
+func (c *Client) addReport(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	wData SecretData, previous *SecretData, recallID []byte,
+	signerG darc.Signer, signerO darc.Signer) error {
+
+	//creating new Report to be added in the list of the reports in the instance
+	var newReport Report
+	newReport.RecallID = recallID
+	//the blinding factor of the mileage commitment goes into the secret
+	err := newReport.CommitMileage(&wData, previous)
+	if err != nil {
+		return err
+	}
 
 	//creating a Calypso Write Instance
 	//key := []byte("secret key")
 	key := random.Bits(128, true, random.New())
-	_, wInstance, err := s.addWrite(key, wData, controlDarc, signerG, signerO)
+	_, wInstance, err := c.AddWrite(key, wData, controlDarc, signerG, signerO)
 	if err != nil {
 		return err
 	}
-
-	//creating new Report to be added in the list of the reports in the instance
-	var newReport Report
-	newReport.Date = time.Now().String()
 	newReport.WriteInstanceID = wInstance.Slice()
-	newReport.GarageId = signerG.Identity().String()
+	return c.sendNewReport(instID, controlDarc, newReport, wData.Kind, signerG, signerO)
+}
+
+// sendNewReport attributes the report of the given kind to the garage of the
+// car and to signerG and adds it to the car instance
+func (c *Client) sendNewReport(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	newReport Report, kind string, signerG darc.Signer, signerO darc.Signer) error {
+
+	newReport.Timestamp = time.Now().UnixNano()
+	newReport.Kind = kind
+	newReport.GarageId = string(controlDarc.Rules.Get("invoke:addReport"))
+	newReport.SignedBy = signerG.Identity().String()
 
-	reportBuf, err := protobuf.Encode(&newReport)
+	instr, err := newReportInstruction(instID, newReport)
 	if err != nil {
 		return err
 	}
-
 	ctx := byzcoin.ClientTransaction{
-		Instructions: []byzcoin.Instruction{{
-			InstanceID: instID,
-			Nonce:      byzcoin.Nonce{},
-			Index:      0,
-			Length:     1,
-			Invoke: &byzcoin.Invoke{
-				Command: "addReport",
-				Args:    byzcoin.Arguments{{Name: "report", Value: reportBuf}},
-			},
-		}},
+		Instructions: []byzcoin.Instruction{instr},
 	}
 	// And we need to sign the instruction with the signer that has his
 	// public key stored in the darc.
@@ -96,12 +109,12 @@ func (s *ser) addReport(instID byzcoin.InstanceID,
 		return err
 	}
 
-	_, err = s.cl.AddTransactionAndWait(ctx,5)
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx,5)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.cl.GetProof(ctx.Instructions[0].InstanceID.Slice())
+	_, err = c.ByzCoin.GetProof(ctx.Instructions[0].InstanceID.Slice())
 	if err != nil {
 		return err
 	}
@@ -109,167 +122,144 @@ func (s *ser) addReport(instID byzcoin.InstanceID,
 	return err
 }
 
-//instID is the ID of the car instance that contains reports with calypso secrets that should be read
-func (s *ser) readReports(instID byzcoin.InstanceID,
+// ReadReports returns the decrypted secrets of the effective history of a
+// car, see EffectiveReports.
+// instID is the ID of the car instance that contains reports with calypso secrets that should be read
+func (c *Client) ReadReports(instID byzcoin.InstanceID,
+	controlDarc *darc.Darc, signerR darc.Signer, signerO darc.Signer) ([]SecretData, error) {
+	return c.ReadReportsOfKind(instID, "", controlDarc, signerR, signerO)
+}
+
+// ReadReportsOfKind returns the decrypted secrets of the effective history of
+// a car with the given kind. Only the secrets of these reports are decrypted,
+// but every report of the car is read: a long history is better read by pages
+// with ReadReportsPage.
+func (c *Client) ReadReportsOfKind(instID byzcoin.InstanceID, kind string,
 	controlDarc *darc.Darc, signerR darc.Signer, signerO darc.Signer) ([]SecretData, error) {
 
-	var secretsList []SecretData
-	//getting the car data from the car instance and storing it in the carData variable
-	resp, err := s.cl.GetProof(instID.Slice())
+	carData, err := c.GetCar(instID)
 	if err != nil {
-		return secretsList, err
+		return nil, err
 	}
-	_,values, _, _, err := resp.Proof.KeyValue()
+	trail, err := c.GetReportsPage(instID, 0, carData.ReportCount)
 	if err != nil {
-		return secretsList, err
+		return nil, err
 	}
-	var carData Car
-	err = protobuf.Decode(values, &carData)
+	return c.readReports(ReportsOfKind(EffectiveReports(trail), kind), controlDarc, signerR, signerO)
+}
+
+// ReadReportsPage returns the decrypted secrets of the effective history of
+// the original reports with an index from from to from+count-1 and the given
+// kind, see GetEffectiveReports. Only the reports of the page are read.
+func (c *Client) ReadReportsPage(instID byzcoin.InstanceID, kind string, from, count uint32,
+	controlDarc *darc.Darc, signerR darc.Signer, signerO darc.Signer) ([]SecretData, error) {
+
+	effective, err := c.GetEffectiveReports(instID, from, count)
 	if err != nil {
-		return secretsList, err
-	}
-
-	//if there is any report, create a calypso read instance in order to read the encrypted secret
-	if len(carData.Reports)>0 {
-
-		for i := 0; i < len(carData.Reports); i++ {
-			//get the proof for the write instance
-			resp, err = s.cl.GetProof(carData.Reports[i].WriteInstanceID)
-			if err != nil {
-				return secretsList, err
-			}
-
-			prWr:= resp.Proof
-			//add read instance
-			prRe, err := s.addRead(&prWr, controlDarc, signerR, signerO)
-
-			dk, err := s.servicesCal[0].DecryptKey(&calypso.DecryptKey{Read: *prRe, Write: prWr})
-			if err != nil {
-				return secretsList, err
-			}
-
-			if dk.X.Equal(s.ltsReply.X) != true {
-				return secretsList, errors.New("the points are not derived from the same group")
-			}
-			key, err := calypso.DecodeKey(cothority.Suite, s.ltsReply.X, dk.Cs, dk.XhatEnc, s.signer.Ed25519.Secret)
-			if err != nil {
-				return secretsList, err
-			}
-
-			//now that we have the symetric key, we can decrypt the secret
-			//getting the write structure from the proof
-			_, value, _ , _, err := prWr.KeyValue()
-			var write calypso.Write
-			err = protobuf.DecodeWithConstructors(value, &write, network.DefaultConstructors(cothority.Suite))
-			if err != nil {
-				return secretsList, err
-			}
-
-			//decrypting the secret and placing it in a SecretData structure
-			plainText, err := decrypt(write.Data, key)
-			if err != nil {
-				return secretsList, err
-			}
-			var secret SecretData
-			err = protobuf.Decode(plainText, &secret)
-			if err != nil {
-				return secretsList, err
-			}
-			secretsList = append(secretsList, secret)
-		}
-
-		return secretsList, err
-	}
-	return secretsList, err
+		return nil, err
+	}
+	return c.readReports(ReportsOfKind(effective, kind), controlDarc, signerR, signerO)
 }
 
-func (s *ser) addRead( write *byzcoin.Proof,
-	controlDarc *darc.Darc, signerR darc.Signer, signerO darc.Signer) (*byzcoin.Proof, error) {
-	var readBuf []byte
-	read := &calypso.Read{
-		Write: byzcoin.NewInstanceID(write.InclusionProof.Key()),
-		Xc:    s.signer.Ed25519.Point,
+// readReports decrypts the secrets of the reports, creating the calypso read
+// instances of all the reports in one transaction
+func (c *Client) readReports(reports []Report, controlDarc *darc.Darc,
+	signerR darc.Signer, signerO darc.Signer) ([]SecretData, error) {
+
+	if len(reports) == 0 {
+		return nil, nil
 	}
-	var err error
-	readBuf, err = protobuf.Encode(read)
+	return c.readSecrets(reports, signerR, func(writeIDs [][]byte) ([]byzcoin.InstanceID, error) {
+		return c.addReads(writeIDs, controlDarc, signerR, signerO)
+	})
+}
+
+// readerPoint returns the public key of the reader, to which Calypso
+// re-encrypts the key of a write instance
+func readerPoint(reader darc.Signer) (kyber.Point, error) {
+	if reader.Ed25519 == nil {
+		return nil, errors.New("the secrets can only be re-encrypted to an ed25519 reader")
+	}
+	return reader.Ed25519.Point, nil
+}
+
+// decryptKey asks Calypso for the symmetric key of the write instance,
+// re-encrypted by the read instance to the point of readerPoint, and
+// decrypts it with the private key of the reader
+func (c *Client) decryptKey(prWr *byzcoin.Proof, prRe *byzcoin.Proof,
+	reader darc.Signer) ([]byte, error) {
+
+	dk, err := c.Calypso.DecryptKey(&calypso.DecryptKey{Read: *prRe, Write: *prWr})
 	if err != nil {
 		return nil, err
 	}
-	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{{
-			InstanceID: byzcoin.NewInstanceID(write.InclusionProof.Key()),
-			Nonce:      byzcoin.Nonce{},
-			Index:      0,
-			Length:     1,
-			Spawn: &byzcoin.Spawn{
-				ContractID: calypso.ContractReadID,
-				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
-			},
-		}},
-	}
-	err = ctx.Instructions[0].SignBy(controlDarc.GetID(), signerR, signerO)
+
+	if dk.X.Equal(c.LTS.X) != true {
+		return nil, errors.New("the points are not derived from the same group")
+	}
+	return calypso.DecodeKey(cothority.Suite, c.LTS.X, dk.Cs, dk.XhatEnc, reader.Ed25519.Secret)
+}
+
+// decryptData decrypts the data of the write instance in the proof with the
+// symmetric key
+func decryptData(prWr *byzcoin.Proof, key []byte) ([]byte, error) {
+	//getting the write structure from the proof
+	_, value, _ , _, err := prWr.KeyValue()
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = s.cl.AddTransactionAndWait(ctx, 5)
+	var write calypso.Write
+	err = protobuf.DecodeWithConstructors(value, &write, network.DefaultConstructors(cothority.Suite))
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := s.cl.GetProof(ctx.Instructions[0].DeriveID("").Slice())
+	//decrypting the secret
+	return decrypt(write.Data, key)
+}
+
+// AddRead spawns a Calypso read instance for the given write instance,
+// re-encrypting to the key of signerR, and returns the proof of the read
+// instance
+func (c *Client) AddRead( write *byzcoin.Proof,
+	controlDarc *darc.Darc, signerR darc.Signer, signerO darc.Signer) (*byzcoin.Proof, error) {
+	readIDs, err := c.addReads([][]byte{write.InclusionProof.Key()}, controlDarc, signerR, signerO)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.ByzCoin.GetProof(readIDs[0].Slice())
 	if err != nil {
 		return nil, err
 	}
 	return &resp.Proof, err
 }
 
-func (s *ser) addWrite(key []byte, wData SecretData,
+// AddWrite encrypts wData with the symmetric key, spawns a Calypso write
+// instance holding it and returns the proof and the ID of the write instance
+func (c *Client) AddWrite(key []byte, wData SecretData,
 	controlDarc *darc.Darc, signerG darc.Signer, signerO darc.Signer) (*byzcoin.Proof, byzcoin.InstanceID, error) {
 
 	var instID byzcoin.InstanceID
-	write := calypso.NewWrite(cothority.Suite, s.ltsReply.LTSID, controlDarc.GetBaseID(), s.ltsReply.X, key)
-	var err error
-
-	writeDataBuf, err := protobuf.Encode(&wData)
-	if err != nil {
-		return nil, instID, err
-	}
-	write.Data, err = encrypt(writeDataBuf, key)
+	writeBuf, err := newSecretWrite(key, wData, controlDarc.GetBaseID(), c.LTS)
 	if err != nil {
 		return nil, instID, err
 	}
-
-	writeBuf, err := protobuf.Encode(write)
-	if err != nil {
-		return nil, instID, err
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{newWriteInstruction(controlDarc.GetBaseID(), writeBuf)},
 	}
 
-	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{{
-			InstanceID: byzcoin.NewInstanceID(controlDarc.GetBaseID()),
-			Nonce:      byzcoin.Nonce{},
-			Index:      0,
-			Length:     1,
-			Spawn: &byzcoin.Spawn{
-				ContractID: calypso.ContractWriteID,
-				Args:       byzcoin.Arguments{{Name: "write", Value: writeBuf}},
-			},
-		}},
-	}
-
-	err = ctx.Instructions[0].SignBy(controlDarc.GetID(), signerG, signerO)
+	err = ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signerG, signerO)
 	if err != nil {
 		return nil, instID, err
 	}
 
-	_, err = s.cl.AddTransactionAndWait(ctx, 5)
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
 	if err != nil {
 		return nil, instID, err
 	}
 	instID = ctx.Instructions[0].DeriveID("")
 
-	resp, err := s.cl.GetProof(instID.Slice())
+	resp, err := c.ByzCoin.GetProof(instID.Slice())
 	if err != nil {
 		return nil, instID, err
 	}
@@ -0,0 +1,90 @@
+package car
+
+/*
+The client.go defines the Client used by applications to register cars, add
+reports and read them back from a ByzCoin ledger running Calypso.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/protobuf"
+)
+
+// Client holds everything needed to talk to a ByzCoin ledger storing car
+// instances and to the Calypso cothority encrypting the reports.
+type Client struct {
+	ByzCoin *byzcoin.Client
+	Calypso *calypso.Client
+	// LTS is the long-term secret of the Calypso cothority, used to encrypt
+	// the secrets of the reports.
+	LTS *calypso.CreateLTSReply
+}
+
+// NewClient returns a Client for the ByzCoin ledger with the given ID,
+// running on the given roster. The LTS has to be set, either with an
+// existing one or by calling CreateLTS, before reports can be added.
+func NewClient(roster onet.Roster, byzcoinID skipchain.SkipBlockID) *Client {
+	return NewClientFromByzCoin(byzcoin.NewClient(byzcoinID, roster))
+}
+
+// NewClientFromByzCoin returns a Client using an existing ByzCoin client.
+func NewClientFromByzCoin(bc *byzcoin.Client) *Client {
+	return &Client{
+		ByzCoin: bc,
+		Calypso: calypso.NewClient(bc),
+	}
+}
+
+// CreateLTS asks the Calypso cothority to create a new long-term secret
+// and stores it in the client.
+func (c *Client) CreateLTS() error {
+	lts, err := c.Calypso.CreateLTS()
+	if err != nil {
+		return err
+	}
+	if lts == nil {
+		return errors.New("got an empty LTS reply")
+	}
+	c.LTS = lts
+	return nil
+}
+
+// GetDarc returns the latest version of the darc from the ledger
+func (c *Client) GetDarc(id darc.ID) (*darc.Darc, error) {
+	resp, err := c.ByzCoin.GetProof(id)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Proof.InclusionProof.Match(id) {
+		return nil, errors.New("absence of the darc in the collection")
+	}
+	_, value, _, _, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	return darc.NewFromProtobuf(value)
+}
+
+// GetCar returns the car stored in the car instance
+func (c *Client) GetCar(instID byzcoin.InstanceID) (*Car, error) {
+	resp, err := c.ByzCoin.GetProof(instID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	_, value, _, _, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	var car Car
+	err = protobuf.Decode(value, &car)
+	if err != nil {
+		return nil, err
+	}
+	return &car, nil
+}
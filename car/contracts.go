@@ -1,7 +1,11 @@
 package car
 
 import (
+	"encoding/hex"
 	"errors"
+	"strings"
+	"time"
+
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/protobuf"
@@ -10,8 +14,13 @@ import (
 
 var ContractCarID = "car"
 
-// ContractCar can only spawn new Car instances and will store the arguments in
-// the data field.
+// ContractCar spawns new Car instances and will store the arguments in
+// the data field. A car can only be spawned with a valid VIN which is not yet
+// registered in the VIN registry, and is active. Its owner is the one of the
+// invoke:transferOwnership rule of the car darc. The instances can then be invoked to add,
+// amend and retract reports, to transfer the ownership of the car, to change its status,
+// to update its public metadata, to grant and revoke time-limited reads, to disclose
+// and read single fields of the secrets and to change its reader and garage.
 func ContractCar(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
 	cIn []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
 
@@ -44,29 +53,122 @@ func ContractCar(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
 		if err != nil {
 			return nil, nil, errors.New("not a car")
 		}
+		err = ValidateVin(car.Vin)
+		if err != nil {
+			return
+		}
+		if car.ReportCount != 0 || car.LastTimestamp != 0 || len(car.MileageCommitment) != 0 {
+			return nil, nil, errors.New("a new car can't have reports")
+		}
+		if car.Status == "" {
+			car.Status = StatusActive
+		}
+		if car.Status != StatusActive {
+			return nil, nil, errors.New("a new car must be active")
+		}
+		err = car.Metadata.Validate()
+		if err != nil {
+			return
+		}
+		//the owner is the one who can transfer the car in its darc, and a new
+		//car has no previous owners
+		if len(car.PreviousOwners) != 0 {
+			return nil, nil, errors.New("a new car can't have previous owners")
+		}
+		if len(car.GrantReaders) != 0 {
+			return nil, nil, errors.New("a new car can't have read grants")
+		}
+		var carDarc *darc.Darc
+		carDarc, err = loadDarc(cdb, darcID)
+		if err != nil {
+			return
+		}
+		car.Owner = string(carDarc.Rules.Get("invoke:transferOwnership"))
+		if car.Owner == "" {
+			return nil, nil, errors.New("the car darc must have an owner")
+		}
+		cBuf, err = protobuf.Encode(&car)
+		if err != nil {
+			return
+		}
+		//the VIN must not be registered yet
+		vinID := VinInstanceID(car.Vin)
+		if _, _, _, errVin := cdb.GetValues(vinID.Slice()); errVin == nil {
+			return nil, nil, errors.New("a car with this VIN already exists")
+		}
 
 		instID := inst.DeriveID("")
-		//creating the Car Instance in the global state
+		var vinBuf []byte
+		vinBuf, err = protobuf.Encode(&VinRecord{Vin: car.Vin, CarInstanceID: instID.Slice()})
+		if err != nil {
+			return
+		}
+		//creating the Car Instance and its VIN registry entry in the global state
 		scs = []byzcoin.StateChange{
 			byzcoin.NewStateChange(byzcoin.Create, instID,
 				inst.Spawn.ContractID, cBuf, darcID),
+			byzcoin.NewStateChange(byzcoin.Create, vinID,
+				ContractVinID, vinBuf, darcID),
 		}
 		return
 	//updates the car instance by adding a new report
 	case byzcoin.InvokeType:
-		if inst.Invoke.Command != "addReport" {
-			return nil, nil, errors.New("Value contract can only add Reports")
-		}
 		//getting the Car Data from the car instance
 		var carBuf []byte
 		carBuf, _, _, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return
+		}
 		car := Car{}
 		err = protobuf.Decode(carBuf, &car)
 		if err != nil {
 			return
 		}
-		//adding reports to the car data
-		err = car.Add(inst.Invoke.Args)
+		err = car.verifyStatus(inst.Invoke.Command)
+		if err != nil {
+			return
+		}
+		var otherSCs []byzcoin.StateChange
+		switch inst.Invoke.Command {
+		case "addReport":
+			//adding reports in their own instances
+			otherSCs, err = car.Add(cdb, inst.InstanceID, darcID, inst.Invoke.Args, inst.Signatures)
+		case "amendReport", "retractReport":
+			//appending the amendment or retraction of a report
+			otherSCs, err = car.Amend(cdb, inst.InstanceID, darcID, inst.Invoke.Args, inst.Signatures,
+				inst.Invoke.Command == "retractReport")
+		case "transferOwnership":
+			//changing the owner and evolving the car darc to the new owner
+			otherSCs, err = car.TransferOwnership(cdb, darcID, inst.Invoke.Args)
+		case "setStatus":
+			//moving the car to another state of its lifecycle
+			err = car.SetStatus(inst.Invoke.Args)
+		case "updateMetadata":
+			//replacing the public description of the car
+			err = car.UpdateMetadata(inst.Invoke.Args)
+		case "grantRead":
+			//letting a reader read the reports for a limited time
+			otherSCs, err = car.GrantRead(cdb, inst.InstanceID, darcID, inst.Invoke.Args)
+		case "revokeRead":
+			otherSCs, err = car.RevokeRead(cdb, inst.InstanceID, darcID, inst.Invoke.Args)
+		case "discloseField":
+			//letting other darcs read one field of the secrets
+			otherSCs, err = car.DiscloseField(cdb, darcID, inst.Invoke.Args)
+		case "grantAccess":
+			//giving the role of reader or garage to another darc
+			otherSCs, err = car.GrantAccess(cdb, darcID, inst.Invoke.Args)
+		case "revokeAccess":
+			otherSCs, err = car.RevokeAccess(cdb, darcID, inst.Invoke.Args)
+		default:
+			if field, ok := fieldOfCommand(inst.Invoke.Command); ok {
+				//reading one field of the secret of a report, which
+				//doesn't change the car
+				scs, err = car.ReadField(cdb, inst, darcID, field)
+				return
+			}
+			err = errors.New("car contract can only add, amend and retract reports, transfer the ownership, " +
+				"set the status, update the metadata, grant reads and accesses and disclose fields")
+		}
 		if err != nil {
 			return
 		}
@@ -74,11 +176,11 @@ func ContractCar(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
 		if err != nil {
 			return
 		}
-		//updating the car instance so that it contains the new reports
-		scs = []byzcoin.StateChange{
+		//updating the car instance so that it contains the changes
+		scs = append([]byzcoin.StateChange{
 			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
 				ContractCarID, carBuf, darcID),
-		}
+		}, otherSCs...)
 		return
 	default:
 		panic("should not get here")
@@ -86,14 +188,101 @@ func ContractCar(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
 }
 
 //the arguments should have "report" as name and the Report marshaled in bytes as value
-func (car *Car) Add(args byzcoin.Arguments) error{
-	var report Report
-	var err error
+//the mileage of every report must not be lower than the mileage of the report before
+//and the timestamp must be close to the current time and not before the report before
+//the report must be signed by the member of the garage of the car given in SignedBy
+//and the garage must be certified in the garage registry at the time of the report
+//every report is stored in a new instance, the returned state changes create them
+func (car *Car) Add(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID, carDarcID darc.ID,
+	args byzcoin.Arguments, signatures []darc.Signature) ([]byzcoin.StateChange, error){
+	var scs []byzcoin.StateChange
+	closed := map[string]bool{}
 	for _, rep := range args {
 		if rep.Name == "report" {
-			err = protobuf.Decode(rep.Value, &report)
-			car.Reports = append(car.Reports, report)
+			var report Report
+			err := protobuf.Decode(rep.Value, &report)
+			if err != nil {
+				return nil, err
+			}
+			err = ValidateReportKind(report.Kind)
+			if err != nil {
+				return nil, err
+			}
+			err = validateWrites(report)
+			if err != nil {
+				return nil, err
+			}
+			err = verifyWrites(cdb, carDarcID, report)
+			if err != nil {
+				return nil, err
+			}
+			err = car.verifyTimestamp(report, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			err = verifyGarage(cdb, carDarcID, report, signatures)
+			if err != nil {
+				return nil, err
+			}
+			err = verifyCertified(cdb, report)
+			if err != nil {
+				return nil, err
+			}
+			err = car.verifyMileage(report)
+			if err != nil {
+				return nil, err
+			}
+			if len(report.RecallID) > 0 {
+				//closing the recall for the car, the report becomes the
+				//next one of the car
+				if closed[string(report.RecallID)] {
+					return nil, errors.New("the recall is already closed for the car")
+				}
+				closed[string(report.RecallID)] = true
+				sc, err := car.closeRecall(cdb, carID, report)
+				if err != nil {
+					return nil, err
+				}
+				scs = append(scs, sc)
+			}
+			sc, err := car.newReportStateChange(carID, report, carDarcID)
+			if err != nil {
+				return nil, err
+			}
+			car.MileageCommitment = report.MileageCommitment
+			scs = append(scs, sc)
 		}
 	}
-	return err
-}
\ No newline at end of file
+	return scs, nil
+}
+
+// loadDarc returns the latest version of the darc from the global state
+func loadDarc(cdb byzcoin.ReadOnlyStateTrie, id darc.ID) (*darc.Darc, error) {
+	darcBuf, contractID, _, err := cdb.GetValues(id)
+	if err != nil {
+		return nil, err
+	}
+	if contractID != byzcoin.ContractDarcID {
+		return nil, errors.New("not a darc instance")
+	}
+	return darc.NewFromProtobuf(darcBuf)
+}
+
+// darcGetter returns the function used to resolve the darcs of an expression
+// from the global state
+func darcGetter(cdb byzcoin.ReadOnlyStateTrie) darc.GetDarc {
+	return func(s string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(s, "darc:") {
+			return nil
+		}
+		id, err := hex.DecodeString(strings.TrimPrefix(s, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := loadDarc(cdb, id)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+}
@@ -0,0 +1,791 @@
+package car
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContract_TransferOwnership(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//the ownership chain of a new car can't be forged, its owner is the
+	//one of its darc
+	car := NewCar("1HGCM82633A004352")
+	car.PreviousOwners = []string{"darc:forged"}
+	_, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.NotNil(t, err)
+	car = NewCar("1HGCM82633A004352")
+	car.Owner = "darc:forged"
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	carData, err := s.client.GetCar(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, d.User.GetIdentityString(), carData.Owner)
+
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//creating the darc of the buyer
+	buyer := darc.NewSignerEd25519(nil, nil)
+	ctx, darcBuyer, err := SpawnDarc(d.Admin, buyer.Identity().String(), "User")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcBuyer.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	//only the owner can transfer the car
+	_, err = s.client.TransferOwnership(cInstance, d.Car, darcBuyer, darcBuyer, darcBuyer, buyer)
+	require.NotNil(t, err)
+	darcCar, err := s.client.TransferOwnership(cInstance, d.Car, darcBuyer, darcBuyer, darcBuyer, d.user)
+	require.Nil(t, err)
+	require.Equal(t, d.Car.Version+1, darcCar.Version)
+
+	carData, err = s.client.GetCar(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, darcBuyer.GetIdentityString(), carData.Owner)
+	require.Equal(t, []string{d.User.GetIdentityString()}, carData.PreviousOwners)
+	require.Equal(t, uint32(1), carData.ReportCount)
+
+	//the seller can neither read nor add reports anymore, the buyer can
+	_, err = s.client.ReadReports(cInstance, darcCar, d.user, d.user)
+	require.NotNil(t, err)
+	secrets, err := s.client.ReadReports(cInstance, darcCar, buyer, buyer)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(secrets))
+	previous := &secrets[0]
+	wData = NewSecretData(ReportAccident, 120000, Kilometers)
+	wData.Accident = &AccidentData{DamagedParts: []string{"bumper"}, RepairCost: 80000, Currency: "CHF"}
+	require.NotNil(t, s.client.AddReport(cInstance, darcCar, wData, previous, d.user, d.user))
+	//the buyer is its own garage, which has to be certified
+	require.NotNil(t, s.client.AddReport(cInstance, darcCar, wData, previous, buyer, buyer))
+	s.certifyGarage(t, darcBuyer)
+	require.Nil(t, s.client.AddReport(cInstance, darcCar, wData, previous, buyer, buyer))
+	secrets, err = s.client.ReadReports(cInstance, darcCar, buyer, buyer)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(secrets))
+	secrets, err = s.client.ReadReportsOfKind(cInstance, ReportAccident, darcCar, buyer, buyer)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(secrets))
+	require.Equal(t, wData.Accident.DamagedParts, secrets[0].Accident.DamagedParts)
+}
+
+func TestContract_ReportSigner(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1M8GDM9AXKP042788"), d.Car, d.admin)
+	require.Nil(t, err)
+	sendReport := func(report Report, signers ...darc.Signer) error {
+		wData := NewSecretData(ReportService, 1000, Kilometers)
+		require.Nil(t, report.CommitMileage(&wData, nil))
+		report.Timestamp = time.Now().UnixNano()
+		report.Kind = ReportService
+		instr, err := newReportInstruction(cInstance, report)
+		require.Nil(t, err)
+		ctx := byzcoin.ClientTransaction{Instructions: byzcoin.Instructions{instr}}
+		require.Nil(t, ctx.Instructions[0].SignBy(d.Car.GetBaseID(), signers...))
+		_, err = s.cl.AddTransactionAndWait(ctx, 5)
+		return err
+	}
+
+	garage := d.Garage.GetIdentityString()
+	//attributed to another garage
+	require.NotNil(t, sendReport(Report{GarageId: d.Reader.GetIdentityString(),
+		SignedBy: d.user.Identity().String()}, d.user))
+	//attributed to somebody who didn't sign
+	require.NotNil(t, sendReport(Report{GarageId: garage,
+		SignedBy: d.admin.Identity().String()}, d.user))
+	//attributed to a signer who is not a member of the garage
+	require.NotNil(t, sendReport(Report{GarageId: garage,
+		SignedBy: d.admin.Identity().String()}, d.user, d.admin))
+	require.Nil(t, sendReport(Report{GarageId: garage,
+		SignedBy: d.user.Identity().String()}, d.user))
+
+	carData, err := s.client.GetCar(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), carData.ReportCount)
+	report, err := s.client.GetReport(cInstance, 0)
+	require.Nil(t, err)
+	require.Equal(t, d.user.Identity().String(), report.SignedBy)
+}
+
+func TestContract_AmendReport(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+	secrets, err := s.client.ReadReports(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	wData2 := NewSecretData(ReportService, 900000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData2, &secrets[0], d.user, d.user))
+
+	//the garage corrects the first report, but can't change its mileage
+	amended := secrets[0]
+	amended.ECOScore = 1200
+	amended.Mileage = 110000
+	require.NotNil(t, s.client.AmendReport(cInstance, d.Car, 0, amended, &secrets[0], "typo", d.user, d.user))
+	amended.Mileage = secrets[0].Mileage
+	require.Nil(t, s.client.AmendReport(cInstance, d.Car, 0, amended, &secrets[0], "typo", d.user, d.user))
+	//only the garage and the admin can retract a report
+	stranger := darc.NewSignerEd25519(nil, nil)
+	require.NotNil(t, s.client.RetractReport(cInstance, d.Car, 1, "fraud", stranger))
+	require.Nil(t, s.client.RetractReport(cInstance, d.Car, 1, "fraud", d.admin))
+	require.NotNil(t, s.client.RetractReport(cInstance, d.Car, 1, "fraud", d.admin))
+
+	effective, trail, err := s.client.ReadHistory(cInstance, 0, MaxReportsPage, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(effective))
+	require.Equal(t, uint32(1200), effective[0].ECOScore)
+	require.Equal(t, 4, len(trail))
+	require.Equal(t, "typo", trail[2].Note)
+	require.True(t, trail[3].Retraction)
+	//the effective history can be read by pages of the audit trail
+	page, err := s.client.GetEffectiveReports(cInstance, 0, 2)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(page))
+	require.Equal(t, "typo", page[0].Note)
+	page, err = s.client.GetReportsPage(cInstance, 2, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page))
+	//and decrypted by pages too
+	pageSecrets, err := s.client.ReadReportsPage(cInstance, "", 0, 1, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(pageSecrets))
+	require.Equal(t, uint32(1200), pageSecrets[0].ECOScore)
+	pageSecrets, err = s.client.ReadReportsPage(cInstance, "", 1, 10, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(pageSecrets))
+	_, trail, err = s.client.ReadHistory(cInstance, 2, 10, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(trail))
+
+	//the mileage of new reports is checked against the effective history
+	wData3 := NewSecretData(ReportService, 120000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData3, &effective[0], d.user, d.user))
+}
+
+func TestContract_VinRegistry(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//invalid VINs are refused
+	_, err := s.client.CreateCarInstance(NewCar("123A2314"), d.Car, d.admin)
+	require.NotNil(t, err)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+
+	//the same VIN can't be registered twice
+	car := NewCar("1hgcm82633a004352")
+	_, err = s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.NotNil(t, err)
+
+	//looking up the car by its VIN
+	instID, darcID, proof, err := s.client.LookupVin("1hgcm82633a004352")
+	require.Nil(t, err)
+	require.Equal(t, cInstance, instID)
+	require.Equal(t, d.Car.GetBaseID(), darcID)
+	_, _, err = VerifyVinProof(proof, s.gbReply.Skipblock.Hash, "1HGCM82633A004352")
+	require.Nil(t, err)
+	_, _, err = VerifyVinProof(proof, s.gbReply.Skipblock.Hash, "1M8GDM9AXKP042788")
+	require.NotNil(t, err)
+
+	_, _, _, err = s.client.LookupVin("1M8GDM9AXKP042788")
+	require.NotNil(t, err)
+}
+
+func TestContract_Lifecycle(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//a new car must be active
+	car := NewCar("1HGCM82633A004352")
+	car.Status = StatusScrapped
+	_, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.NotNil(t, err)
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//only the admin and the owner can change the status
+	stranger := darc.NewSignerEd25519(nil, nil)
+	require.NotNil(t, s.client.SetStatus(cInstance, d.Car, StatusStolen, stranger))
+	require.Nil(t, s.client.SetStatus(cInstance, d.Car, StatusStolen, d.user))
+	status, err := s.client.GetStatus(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, StatusStolen, status)
+	require.Nil(t, s.client.SetStatus(cInstance, d.Car, StatusScrapped, d.admin))
+
+	//a scrapped car doesn't get new reports and stays scrapped
+	secrets, err := s.client.ReadReports(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	wData2 := NewSecretData(ReportService, 120000, Kilometers)
+	require.NotNil(t, s.client.AddReport(cInstance, d.Car, wData2, &secrets[0], d.user, d.user))
+	require.NotNil(t, s.client.SetStatus(cInstance, d.Car, StatusActive, d.admin))
+	//but its history can still be corrected
+	require.Nil(t, s.client.RetractReport(cInstance, d.Car, 0, "wrong car", d.admin))
+
+	//the VIN of a scrapped car can't be spawned again
+	_, err = s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.NotNil(t, err)
+}
+
+func TestContract_Metadata(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	car.Metadata = CarMetadata{Make: "Honda", Model: "Accord", ModelYear: 2003}
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+
+	//only the admin can update the metadata
+	metadata := car.Metadata
+	metadata.FuelType = FuelPetrol
+	metadata.Colour = "silver"
+	require.NotNil(t, s.client.UpdateMetadata(cInstance, d.Car, metadata, d.user))
+	require.NotNil(t, s.client.UpdateMetadata(cInstance, d.Car, CarMetadata{FuelType: "coal"}, d.admin))
+	require.Nil(t, s.client.UpdateMetadata(cInstance, d.Car, metadata, d.admin))
+
+	//the metadata can be read by anybody looking up the VIN
+	service := s.local.GetServices(s.servers, carServiceID)[0].(*Service)
+	reply, err := service.LookupVin(&LookupVin{ByzCoinID: s.gbReply.Skipblock.Hash, Vin: car.Vin})
+	require.Nil(t, err)
+	require.Equal(t, metadata, reply.Metadata)
+}
+
+func TestContract_GarageRegistry(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//the registry exists only once
+	require.NotNil(t, s.client.CreateGarageRegistry(s.gDarc, s.gDarc.GetBaseID(), s.signer))
+	//only the authority certifies garages
+	garage := CertifiedGarage{
+		GarageDarcID: d.Reader.GetBaseID(),
+		Name:         "Reader garage",
+		Licence:      "CH-5678",
+		ValidFrom:    time.Now().Add(-time.Hour).Unix(),
+		ValidUntil:   time.Now().Add(time.Hour).Unix(),
+	}
+	require.NotNil(t, s.client.CertifyGarage(s.gDarc, garage, d.admin))
+	require.Nil(t, s.client.CertifyGarage(s.gDarc, garage, s.signer))
+	certified, err := s.client.GetCertifiedGarage(d.Reader.GetBaseID())
+	require.Nil(t, err)
+	require.Equal(t, "CH-5678", certified.Licence)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//a revoked garage can't add reports anymore
+	require.NotNil(t, s.client.RevokeGarage(s.gDarc, d.Garage.GetBaseID(), d.admin))
+	require.Nil(t, s.client.RevokeGarage(s.gDarc, d.Garage.GetBaseID(), s.signer))
+	certified, err = s.client.GetCertifiedGarage(d.Garage.GetBaseID())
+	require.Nil(t, err)
+	require.True(t, certified.Revoked)
+	secrets, err := s.client.ReadReports(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	wData2 := NewSecretData(ReportService, 110000, Kilometers)
+	require.NotNil(t, s.client.AddReport(cInstance, d.Car, wData2, &secrets[0], d.user, d.user))
+	//nor amend its reports, which the admin still can
+	amended := secrets[0]
+	amended.ECOScore = 1200
+	require.NotNil(t, s.client.AmendReport(cInstance, d.Car, 0, amended, &secrets[0], "typo", d.user, d.user))
+	require.Nil(t, s.client.RetractReport(cInstance, d.Car, 0, "revoked garage", d.admin))
+}
+
+func TestContract_ReadGrant(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//the buyer can't read without a grant
+	buyer := darc.NewSignerEd25519(nil, nil)
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), buyer)
+	require.NotNil(t, err)
+
+	//only the owner grants reads, for at most 30 days
+	require.NotNil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().Add(48*time.Hour), buyer))
+	require.NotNil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().AddDate(0, 2, 0), d.user))
+	require.Nil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().Add(48*time.Hour), d.user))
+	secrets, err := s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), buyer)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(secrets))
+	require.Equal(t, wData.Mileage, secrets[0].Mileage)
+	//the grant is only for the buyer
+	stranger := darc.NewSignerEd25519(nil, nil)
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), stranger)
+	require.NotNil(t, err)
+
+	//the owner can end the grant before it expires
+	require.Nil(t, s.client.RevokeReadGrant(cInstance, d.Car, buyer.Identity(), d.user))
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), buyer)
+	require.NotNil(t, err)
+
+	//the reads are refused once the grant expired
+	require.Nil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().Add(5*time.Second), d.user))
+	time.Sleep(6 * time.Second)
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), buyer)
+	require.NotNil(t, err)
+}
+
+func TestContract_SelectiveDisclosure(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	wData.CheckNote = "new tires"
+	require.Nil(t, s.client.AddReportByField(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//the readers of the car read all the fields
+	secrets, err := s.client.ReadReportsOfKind(cInstance, "", d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(secrets))
+	require.Equal(t, wData.Mileage, secrets[0].Mileage)
+	require.Equal(t, wData.CheckNote, secrets[0].CheckNote)
+
+	//creating the darc of the insurer
+	insurer := darc.NewSignerEd25519(nil, nil)
+	ctx, darcInsurer, err := SpawnDarc(d.Admin, insurer.Identity().String(), "User")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcInsurer.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	//only the owner discloses the mileage to the insurer
+	_, err = s.client.DiscloseField(cInstance, d.Car, FieldMileage, []darc.ID{darcInsurer.GetBaseID()}, insurer)
+	require.NotNil(t, err)
+	darcCar, err := s.client.DiscloseField(cInstance, d.Car, FieldMileage, []darc.ID{darcInsurer.GetBaseID()}, d.user)
+	require.Nil(t, err)
+	require.Equal(t, d.Car.Version+1, darcCar.Version)
+	parts, err := s.client.ReadReportField(cInstance, darcCar, FieldMileage, insurer)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(parts))
+	require.Equal(t, wData.Mileage, parts[0].Mileage)
+	require.Equal(t, "", parts[0].CheckNote)
+
+	//the other fields stay hidden from the insurer
+	_, err = s.client.ReadReportField(cInstance, darcCar, FieldNotes, insurer)
+	require.NotNil(t, err)
+	_, err = s.client.ReadReportsOfKind(cInstance, "", darcCar, insurer, insurer)
+	require.NotNil(t, err)
+
+	//the reports of another car can't point to the writes of this car
+	darcOther := newCarDarc(d.Admin, d.User, d.Reader, d.Garage, "Car darc 1M8GDM9AXKP042788")
+	otherBuf, err := darcOther.ToProto()
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(newSpawnDarcTransaction(d.Admin, otherBuf), d.admin, d.Admin,
+		byzcoin.NewInstanceID(darcOther.GetBaseID()).Slice())
+	require.Nil(t, err)
+	other, err := s.client.CreateCarInstance(NewCar("1M8GDM9AXKP042788"), darcOther, d.admin)
+	require.Nil(t, err)
+	report, err := s.client.GetReport(cInstance, 0)
+	require.Nil(t, err)
+	stolen := Report{FieldWrites: report.FieldWrites}
+	wOther := NewSecretData(ReportService, 1000, Kilometers)
+	require.Nil(t, stolen.CommitMileage(&wOther, nil))
+	require.NotNil(t, s.client.sendNewReport(other, darcOther, stolen, ReportService, d.user, d.user))
+	stolen.FieldWrites = nil
+	require.Nil(t, s.client.sendNewReport(other, darcOther, stolen, ReportService, d.user, d.user))
+	//nor can their amendments
+	amendment, err := s.client.newAmendment(other, 0, d.user)
+	require.Nil(t, err)
+	amendment.Kind = ReportService
+	amendment.FieldWrites = report.FieldWrites
+	require.NotNil(t, s.client.sendReportCommand(other, "amendReport", *amendment, darcOther, d.user, d.user))
+}
+
+func TestContract_ReadManyReports(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	var previous *SecretData
+	for i := 0; i < 6; i++ {
+		wData := NewSecretData(ReportService, uint64(10000*(i+1)), Kilometers)
+		if i%2 == 0 {
+			require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, previous, d.user, d.user))
+		} else {
+			require.Nil(t, s.client.AddReportByField(cInstance, d.Car, wData, previous, d.user, d.user))
+		}
+		previous = &wData
+	}
+
+	//the read instances of all the reports are spawned at once and the
+	//secrets come back in the order of the history
+	secrets, err := s.client.ReadReports(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 6, len(secrets))
+	for i, secret := range secrets {
+		require.Equal(t, uint64(10000*(i+1)), secret.Mileage)
+	}
+}
+
+func TestContract_ReadAccesses(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+	accesses, next, err := s.client.GetReadAccesses(cInstance, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(accesses))
+	_, _, err = s.client.GetReadAccesses(cInstance, -1)
+	require.NotNil(t, err)
+
+	//the reads of the reader and of a buyer with a grant are both listed
+	_, err = s.client.ReadReports(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	buyer := darc.NewSignerEd25519(nil, nil)
+	require.Nil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().Add(48*time.Hour), d.user))
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyer.Identity(), buyer)
+	require.Nil(t, err)
+
+	//only the new blocks are read from the index returned the last time
+	accesses, next, err = s.client.GetReadAccesses(cInstance, next)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(accesses))
+	require.Equal(t, "spawn:calypsoRead", accesses[0].Action)
+	require.Equal(t, d.user.Identity().String(), accesses[0].Readers[0])
+	require.Equal(t, "invoke:read", accesses[1].Action)
+	require.Equal(t, []string{buyer.Identity().String()}, accesses[1].Readers)
+	require.True(t, accesses[1].Xc.Equal(buyer.Ed25519.Point))
+	require.True(t, accesses[0].Timestamp <= accesses[1].Timestamp)
+	for _, access := range accesses {
+		require.Equal(t, uint32(0), access.ReportIndex)
+	}
+	require.True(t, accesses[1].BlockIndex < next)
+	accesses, _, err = s.client.GetReadAccesses(cInstance, next)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(accesses))
+	//all the reads are found again from the genesis block
+	accesses, _, err = s.client.GetReadAccesses(cInstance, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(accesses))
+
+	//the reads with a grant to a darc are listed too
+	member := darc.NewSignerEd25519(nil, nil)
+	ctx, darcBuyer, err := SpawnDarc(d.Admin, member.Identity().String(), "Buyer")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcBuyer.GetBaseID()).Slice())
+	require.Nil(t, err)
+	buyerID := darc.NewIdentityDarc(darcBuyer.GetBaseID())
+	require.Nil(t, s.client.GrantRead(cInstance, d.Car, buyerID, time.Now().Add(48*time.Hour), d.user))
+	_, err = s.client.ReadReportsWithGrant(cInstance, buyerID, member)
+	require.Nil(t, err)
+	accesses, _, err = s.client.GetReadAccesses(cInstance, next)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(accesses))
+	require.Equal(t, "invoke:read", accesses[0].Action)
+	require.Equal(t, []string{member.Identity().String()}, accesses[0].Readers)
+}
+
+func TestContract_AccessRequest(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+
+	//creating the darcs of a buyer and of an insurer
+	buyer := darc.NewSignerEd25519(nil, nil)
+	ctx, darcBuyer, err := SpawnRequesterDarc(d.Admin, buyer.Identity().String(), "Buyer")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcBuyer.GetBaseID()).Slice())
+	require.Nil(t, err)
+	insurer := darc.NewSignerEd25519(nil, nil)
+	ctx, darcInsurer, err := SpawnRequesterDarc(d.Admin, insurer.Identity().String(), "Insurer")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcInsurer.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	//only the darcs of requesters can ask for access
+	other := darc.NewSignerEd25519(nil, nil)
+	ctx, darcOther, err := SpawnDarc(d.Admin, other.Identity().String(), "User")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcOther.GetBaseID()).Slice())
+	require.Nil(t, err)
+	_, err = s.client.RequestAccess(darcOther, cInstance, ScopeReports, "", other)
+	require.NotNil(t, err)
+
+	//the requests are listed for the owner
+	_, err = s.client.RequestAccess(darcBuyer, cInstance, "owner", "", buyer)
+	require.NotNil(t, err)
+	buyerRequest, err := s.client.RequestAccess(darcBuyer, cInstance, ScopeReports, "buying the car", buyer)
+	require.Nil(t, err)
+	insurerRequest, err := s.client.RequestAccess(darcInsurer, cInstance, FieldMileage, "pay as you drive", insurer)
+	require.Nil(t, err)
+	//a requester has only one pending request for the car
+	_, err = s.client.RequestAccess(darcBuyer, cInstance, FieldMileage, "again", buyer)
+	require.NotNil(t, err)
+	ids, requests, err := s.client.GetPendingRequests(d.User.GetIdentityString())
+	require.Nil(t, err)
+	require.Equal(t, []byzcoin.InstanceID{buyerRequest, insurerRequest}, ids)
+	require.Equal(t, darcBuyer.GetIdentityString(), requests[0].Requester)
+	require.Equal(t, "buying the car", requests[0].Reason)
+	require.Equal(t, RequestPending, requests[1].Status)
+
+	//only the owner approves, which grants the reads
+	require.NotNil(t, s.client.ApproveAccess(buyerRequest, d.Car, time.Now().Add(48*time.Hour), buyer))
+	require.Nil(t, s.client.ApproveAccess(buyerRequest, d.Car, time.Now().Add(48*time.Hour), d.user))
+	require.NotNil(t, s.client.DenyAccess(buyerRequest, d.Car, d.user))
+	secrets, err := s.client.ReadReportsWithGrant(cInstance, darc.NewIdentityDarc(darcBuyer.GetBaseID()), buyer)
+	require.Nil(t, err)
+	require.Equal(t, wData.Mileage, secrets[0].Mileage)
+
+	//a denied request gives no access
+	require.Nil(t, s.client.DenyAccess(insurerRequest, d.Car, d.user))
+	request, err := s.client.GetAccessRequest(insurerRequest)
+	require.Nil(t, err)
+	require.Equal(t, RequestDenied, request.Status)
+	ids, _, err = s.client.GetPendingRequests(d.User.GetIdentityString())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+}
+
+func TestContract_CoOwnership(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//the lessee and the leasing company both own the car
+	lessee := darc.NewSignerEd25519(nil, nil)
+	company := darc.NewSignerEd25519(nil, nil)
+	ctx, darcOwners, err := SpawnOwnerDarc(d.Admin, []string{lessee.Identity().String(),
+		company.Identity().String()}, 2, "Lease")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcOwners.GetBaseID()).Slice())
+	require.Nil(t, err)
+	ctx, darcCar, err := SpawnCarDarc(d.Admin, darcOwners, d.Reader, d.Garage)
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcCar.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	car := NewCar("1HGCM82633A004352")
+	cInstance, err := s.client.CreateCarInstance(car, darcCar, d.admin)
+	require.Nil(t, err)
+
+	//granting a read needs both owners
+	buyer := darc.NewSignerEd25519(nil, nil)
+	expiry := time.Now().Add(48 * time.Hour)
+	require.NotNil(t, s.client.GrantRead(cInstance, darcCar, buyer.Identity(), expiry, lessee))
+	require.Nil(t, s.client.GrantRead(cInstance, darcCar, buyer.Identity(), expiry, lessee, company))
+
+	//a new lessee replaces the former one, with the approval of both
+	newLessee := darc.NewSignerEd25519(nil, nil)
+	owners := []string{newLessee.Identity().String(), company.Identity().String()}
+	_, err = s.client.SetOwners(darcOwners, owners, 2, company)
+	require.NotNil(t, err)
+	darcOwners, err = s.client.SetOwners(darcOwners, owners, 2, lessee, company)
+	require.Nil(t, err)
+
+	//the transfer needs the new lessee and the company
+	_, err = s.client.TransferOwnership(cInstance, darcCar, d.User, d.Reader, d.Garage, lessee, company)
+	require.NotNil(t, err)
+	_, err = s.client.TransferOwnership(cInstance, darcCar, d.User, d.Reader, d.Garage, newLessee, company)
+	require.Nil(t, err)
+	carData, err := s.client.GetCar(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, d.User.GetIdentityString(), carData.Owner)
+}
+
+func TestContract_Fleet(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	//the user is the fleet owner, an invalid or repeated VIN doesn't stop
+	//the others
+	vins := []string{"1HGCM82633A004352", "not a vin", "1hgcm82633a004352", "1M8GDM9AXKP042788"}
+	results := s.client.RegisterFleet(d.Admin, d.User, d.Reader, d.Garage, vins, d.admin)
+	require.Equal(t, len(vins), len(results))
+	require.Nil(t, results[0].Err)
+	require.NotNil(t, results[1].Err)
+	require.NotNil(t, results[2].Err)
+	require.Nil(t, results[3].Err)
+	cars := []byzcoin.InstanceID{results[0].InstanceID, results[3].InstanceID}
+	carDarcID := results[0].CarDarc.GetBaseID()
+	for i, instID := range cars {
+		//the returned IDs are the ones of the spawned cars
+		carData, err := s.client.GetCar(instID)
+		require.Nil(t, err)
+		require.Equal(t, []string{vins[0], vins[3]}[i], carData.Vin)
+		require.Equal(t, d.User.GetIdentityString(), carData.Owner)
+		lookedUp, _, _, err := s.client.LookupVin(carData.Vin)
+		require.Nil(t, err)
+		require.Equal(t, lookedUp, instID)
+	}
+
+	//a VIN can't be registered twice
+	results = s.client.RegisterFleet(d.Admin, d.User, d.Reader, d.Garage, vins[:1], d.admin)
+	require.NotNil(t, results[0].Err)
+
+	//a new reader for the whole fleet, which only the owner can give
+	ctx, darcInsurer, err := SpawnDarc(d.Admin, d.User.GetIdentityString(), "Insurer")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcInsurer.GetBaseID()).Slice())
+	require.Nil(t, err)
+	for _, r := range s.client.GrantFleetAccess(cars, RoleReader, darcInsurer.GetBaseID(), d.admin) {
+		require.NotNil(t, r.Err)
+	}
+	results = s.client.GrantFleetAccess(append(cars, byzcoin.NewInstanceID(d.Car.GetBaseID())),
+		RoleReader, darcInsurer.GetBaseID(), d.user)
+	require.Nil(t, results[0].Err)
+	require.Nil(t, results[1].Err)
+	require.NotNil(t, results[2].Err)
+	carDarc, err := s.client.GetDarc(carDarcID)
+	require.Nil(t, err)
+	require.Equal(t, darcInsurer.GetIdentityString(), string(carDarc.Rules.Get("spawn:calypsoRead")))
+
+	//revoking gives the role back to the fleet owner
+	for _, r := range s.client.RevokeFleetAccess(cars, RoleReader, d.user) {
+		require.Nil(t, r.Err)
+	}
+	carDarc, err = s.client.GetDarc(carDarc.GetBaseID())
+	require.Nil(t, err)
+	require.Equal(t, d.User.GetIdentityString(), string(carDarc.Rules.Get("spawn:calypsoRead")))
+	for _, r := range s.client.RevokeFleetAccess(cars, "owner", d.user) {
+		require.NotNil(t, r.Err)
+	}
+}
+
+func TestContract_Recall(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+	ids, _, err := s.client.GetOpenRecalls(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+
+	//only a manufacturer darc spawns recalls
+	manufacturer := darc.NewSignerEd25519(nil, nil)
+	_, err = s.client.SpawnRecall(d.User, "Airbag", nil, []string{"1HGCM"}, d.user)
+	require.NotNil(t, err)
+	ctx, darcManufacturer, err := SpawnManufacturerDarc(d.Admin, manufacturer.Identity().String(), "Manufacturer")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(darcManufacturer.GetBaseID()).Slice())
+	require.Nil(t, err)
+	recallID, err := s.client.SpawnRecall(darcManufacturer, "Airbag", nil, []string{"1hgcm"}, manufacturer)
+	require.Nil(t, err)
+	otherID, err := s.client.SpawnRecall(darcManufacturer, "Brakes", []string{"1M8GDM9AXKP042788"}, nil, manufacturer)
+	require.Nil(t, err)
+
+	ids, recalls, err := s.client.GetOpenRecalls(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, []byzcoin.InstanceID{recallID}, ids)
+	require.Equal(t, darcManufacturer.GetIdentityString(), recalls[0].Manufacturer)
+
+	//the garage can't close a recall of another car
+	wData := NewSecretData(ReportRecall, 1000, Kilometers)
+	require.NotNil(t, s.client.AddRecallReport(cInstance, otherID, d.Car, wData, nil, d.user, d.user))
+	require.Nil(t, s.client.AddRecallReport(cInstance, recallID, d.Car, wData, nil, d.user, d.user))
+	previous := wData
+	require.NotNil(t, s.client.AddRecallReport(cInstance, recallID, d.Car, wData, &previous, d.user, d.user))
+
+	ids, _, err = s.client.GetOpenRecalls(cInstance)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+	recall, err := s.client.GetRecall(recallID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(recall.Closures))
+	require.Equal(t, "1HGCM82633A004352", recall.Closures[0].Vin)
+	require.Equal(t, d.Garage.GetIdentityString(), recall.Closures[0].GarageId)
+	report, err := s.client.GetReport(cInstance, recall.Closures[0].ReportIndex)
+	require.Nil(t, err)
+	require.Equal(t, recallID.Slice(), report.RecallID)
+}
+
+func TestContract_HistoryBundle(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+
+	cInstance, err := s.client.CreateCarInstance(NewCar("1HGCM82633A004352"), d.Car, d.admin)
+	require.Nil(t, err)
+	wData := NewSecretData(ReportService, 10000, Kilometers)
+	require.Nil(t, s.client.AddReport(cInstance, d.Car, wData, nil, d.user, d.user))
+	wData2 := NewSecretData(ReportInspection, 20000, Kilometers)
+	require.Nil(t, s.client.AddReportByField(cInstance, d.Car, wData2, &wData, d.user, d.user))
+	require.Nil(t, s.client.RetractReport(cInstance, d.Car, 0, "wrong car", d.admin))
+
+	//the bundle only holds the secrets of the effective history
+	b, err := s.client.ExportHistory(cInstance, d.Car, d.user, d.user)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(b.Reports))
+	require.Equal(t, 1, len(b.Secrets))
+	require.Equal(t, uint32(1), b.Secrets[0].ReportIndex)
+	require.Equal(t, len(SecretFields), len(b.Secrets[0].Writes))
+	require.Equal(t, wData2.Mileage, b.Secrets[0].Secret.Mileage)
+	buf, err := EncodeHistoryBundle(b)
+	require.Nil(t, err)
+
+	genesisID := s.gbReply.Skipblock.Hash
+	verified, err := VerifyHistoryBundle(buf, genesisID)
+	require.Nil(t, err)
+	require.Equal(t, "1HGCM82633A004352", verified.Car.Vin)
+	_, err = VerifyHistoryBundle(buf, skipchain.SkipBlockID(s.gDarc.GetBaseID()))
+	require.NotNil(t, err)
+
+	//any change to the values of the bundle is found
+	tampered, err := DecodeHistoryBundle(buf)
+	require.Nil(t, err)
+	tampered.Secrets[0].Secret.Mileage = 15000
+	require.NotNil(t, tampered.Verify(genesisID))
+	tampered, err = DecodeHistoryBundle(buf)
+	require.Nil(t, err)
+	tampered.Car.PreviousOwners = []string{"darc:stolen"}
+	require.NotNil(t, tampered.Verify(genesisID))
+	tampered, err = DecodeHistoryBundle(buf)
+	require.Nil(t, err)
+	tampered.Secrets[0].ReportIndex = 0
+	require.NotNil(t, tampered.Verify(genesisID))
+
+	//a buyer with a read grant exports the same history
+	buyer := darc.NewSignerEd25519(nil, nil)
+	require.Nil(t, s.client.GrantRead(cInstance, d.Car, buyer.Identity(), time.Now().Add(48*time.Hour), d.user))
+	b, err = s.client.ExportHistoryWithGrant(cInstance, buyer.Identity(), buyer)
+	require.Nil(t, err)
+	require.Nil(t, b.Verify(genesisID))
+	require.Equal(t, wData2.Mileage, b.Secrets[0].Secret.Mileage)
+}
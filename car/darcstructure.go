@@ -3,20 +3,16 @@ package car
 import (
 	"bytes"
 	"errors"
-	"github.com/dedis/kyber/suites"
 	"strings"
-	"time"
 
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
 )
 
-var testInterval = 500 * time.Millisecond
-var tSuite = suites.MustFind("Ed25519")
-
-// Spawn a new Admin Darc with a rule to spawn other darcs
-func spawnAdminDarc(controlDarc *darc.Darc, user darc.Signer) (byzcoin.ClientTransaction, *darc.Darc, error){
+// SpawnAdminDarc returns a transaction spawning a new Admin Darc with a
+// rule to spawn other darcs
+func SpawnAdminDarc(controlDarc *darc.Darc, user darc.Signer) (byzcoin.ClientTransaction, *darc.Darc, error){
 
 	var ctx byzcoin.ClientTransaction
 	idUser := []darc.Identity{user.Identity()}
@@ -32,8 +28,9 @@ func spawnAdminDarc(controlDarc *darc.Darc, user darc.Signer) (byzcoin.ClientTra
 	return ctx, newDarc, err
 }
 
-// Spawn a new Darc from an existing control Darc(input)
-func spawnDarc(controlDarc *darc.Darc, idString string, role string) (byzcoin.ClientTransaction, *darc.Darc, error){
+// SpawnDarc returns a transaction spawning a new Darc from an existing
+// control Darc(input)
+func SpawnDarc(controlDarc *darc.Darc, idString string, role string) (byzcoin.ClientTransaction, *darc.Darc, error){
 
 	var ctx byzcoin.ClientTransaction
 	//rules for the new Reader Darc
@@ -55,11 +52,32 @@ func spawnDarc(controlDarc *darc.Darc, idString string, role string) (byzcoin.Cl
 	return ctx, newDarc, err
 }
 
-
-func spawnCarDarc( darcAdmin *darc.Darc, darcReader *darc.Darc,
+// SpawnCarDarc returns a transaction spawning the Darc of a car from the
+// admin darc. The admin spawns the car instance and updates its metadata. The
+// owner transfers the car, grants time-limited reads, discloses single fields,
+// answers access requests and changes the reader and the garage. The readers
+// read the reports and the garages add them. The admin and the garages amend
+// and retract the reports, and the admin and the owner change the status of
+// the car.
+func SpawnCarDarc( darcAdmin *darc.Darc, darcOwner *darc.Darc, darcReader *darc.Darc,
 	darcGarage *darc.Darc) (byzcoin.ClientTransaction, *darc.Darc, error) {
 
 	var ctx byzcoin.ClientTransaction
+	darcCar := newCarDarc(darcAdmin, darcOwner, darcReader, darcGarage, "Car darc")
+	darcCarBuf, err := darcCar.ToProto()
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx = newSpawnDarcTransaction(darcAdmin, darcCarBuf)
+
+	return ctx, darcCar, err
+}
+
+// newCarDarc returns the darc of a car with the rules of SpawnCarDarc and
+// the description, which must be different for every car
+func newCarDarc(darcAdmin *darc.Darc, darcOwner *darc.Darc, darcReader *darc.Darc,
+	darcGarage *darc.Darc, description string) *darc.Darc {
+
 	//rules for the new Car Darc
 	rs := darc.NewRules()
 	if err := rs.AddRule("spawn:car", expression.InitAndExpr(darcAdmin.GetIdentityString())); err != nil {
@@ -74,15 +92,51 @@ func spawnCarDarc( darcAdmin *darc.Darc, darcReader *darc.Darc,
 	if err := rs.AddRule("spawn:calypsoWrite", expression.InitAndExpr(darcGarage.GetIdentityString())); err != nil {
 		panic("add rule should never fail on an empty rule list: " + err.Error())
 	}
-	darcCar := darc.NewDarc(rs,
-		[]byte("Car darc"))
-	darcCarBuf, err := darcCar.ToProto()
-	if err != nil {
-		return ctx, nil, err
+	if err := rs.AddRule("invoke:transferOwnership", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
 	}
-	ctx = newSpawnDarcTransaction(darcAdmin, darcCarBuf)
-
-	return ctx, darcCar, err
+	if err := rs.AddRule("invoke:grantRead", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:revokeRead", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:discloseField", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:approveAccess", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:denyAccess", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:grantAccess", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:revokeAccess", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	for _, field := range SecretFields {
+		action := darc.Action("invoke:" + FieldReadCommand(field))
+		if err := rs.AddRule(action, expression.InitAndExpr(darcReader.GetIdentityString())); err != nil {
+			panic("add rule should never fail on an empty rule list: " + err.Error())
+		}
+	}
+	amenders := expression.InitOrExpr(darcAdmin.GetIdentityString(), darcGarage.GetIdentityString())
+	if err := rs.AddRule("invoke:amendReport", amenders); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:retractReport", amenders); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:setStatus", expression.InitOrExpr(darcAdmin.GetIdentityString(),
+		darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("invoke:updateMetadata", expression.InitAndExpr(darcAdmin.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	return darc.NewDarc(rs, []byte(description))
 }
 
 /*
@@ -91,10 +145,13 @@ assume the following rule:
 
 (Pub_m1 | Pub_m2 | ...) & DarcUser
 
-where m1 is member1, ...
+where m1 is member1, ... Any other rule, like the threshold of an owner
+darc, is refused.
  */
 
-func (s *ser) removeSigner(d *darc.Darc,
+// RemoveSigner evolves a Reader or Garage Darc so that signerToBeRemoved is
+// no longer one of its members
+func (c *Client) RemoveSigner(d *darc.Darc,
 	signerToBeRemoved darc.Signer, signer darc.Signer) (*darc.Darc, error){
 
 	if !(bytes.Equal(d.Description, []byte("Reader darc")) || bytes.Equal(d.Description, []byte("Garage darc"))) {
@@ -108,13 +165,13 @@ func (s *ser) removeSigner(d *darc.Darc,
 	}
 	//updating the sign expression
 	oldExp := d.Rules.GetSignExpr()
-	exp, err := removeSignerFromExpr(oldExp, signerToBeRemoved)
+	exp, err := removeSignerFromExpr(oldExp, signerToBeRemoved.Identity().String())
 	if err != nil {
 		return nil, err
 	}
 	d2.Rules.UpdateSign([]byte(exp))
 
-	pr,err := s.evolveDarc(d2, signer)
+	pr,err := c.EvolveDarc(d2, signer)
 	if err != nil {
 		return nil, err
 	}
@@ -138,72 +195,30 @@ func (s *ser) removeSigner(d *darc.Darc,
 }
 
 
-func removeSignerFromExpr(oldExp expression.Expr, removedMember darc.Signer) (expression.Expr, error){
-
-	exp := ""
-	var err error
-
-	//if the member to be removed doesn't exist in the expression, nothing needs to be done (old expr returned)
-	if !(strings.Contains(string(oldExp), removedMember.Identity().String())) {
-		return oldExp, err
-	}
-
-	//otherwise split the expression into members connected with OR (Pub_m1 | Pub_m2 | ...)
-	//and the Darc of the user that owns the Car
-	dPart := ""
-	otherPart := ""
-	oldExpStr := strings.Split(string(oldExp), "&")
+// removeSignerFromExpr returns the sign expression without the member, or
+// the old expression if the member isn't in it
+func removeSignerFromExpr(oldExp expression.Expr, removedMember string) (expression.Expr, error){
 
-	//checking which part of the expression contains the darc Identity
-	if strings.Contains(oldExpStr[0], "darc"){
-		dPart = removeSpace(oldExpStr[0])
-		otherPart = removeSpace(oldExpStr[1])
-	}
-	if strings.Contains(oldExpStr[1], "darc"){
-		dPart = removeSpace(oldExpStr[1])
-		otherPart = removeSpace(oldExpStr[0])
-	}
-
-	if dPart == "" || otherPart == ""{
-		return nil, errors.New("invalid expression")
+	user, members, err := parseMembersExpr(oldExp)
+	if err != nil {
+		return nil, err
 	}
-
-	//if there aren't brackets it means there should be only the darc identity after the removal
-	if !(strings.Contains(otherPart, "(")){
-		exp = removeSpace(dPart)
-		return []byte(exp), err
-	} else {
-		temp_before := " | " + removedMember.Identity().String()
-		temp_after := removedMember.Identity().String() + " | "
-
-
-		if (strings.Contains(otherPart, temp_before)) {
-			otherPart := strings.Replace(otherPart, temp_before, "",-1)
-			if !(strings.Contains(otherPart, "|")) {
-				otherPart = strings.Trim(otherPart,"(")
-				otherPart = strings.Trim(otherPart,")")
-			}
-			exp = removeSpace(otherPart) + " & " + removeSpace(dPart)
-			return []byte(exp), err
+	var left []string
+	for _, m := range members {
+		if m != removedMember {
+			left = append(left, m)
 		}
-
-		if (strings.Contains(otherPart, temp_after)) {
-			otherPart := strings.Replace(otherPart, temp_after, "",-1)
-			if !(strings.Contains(otherPart, "|")) {
-				otherPart = strings.Trim(otherPart,"(")
-				otherPart = strings.Trim(otherPart,")")
-			}
-			exp = removeSpace(otherPart) + " & " + removeSpace(dPart)
-			return []byte(exp), err
-		}
-
 	}
-	exp = removeSpace(otherPart) + " & " + removeSpace(dPart)
-	return []byte(exp), err
+	if len(left) == len(members) {
+		return oldExp, nil
+	}
+	return membersExpr(user, left), nil
 }
 
 
-func (s *ser) addSigner(d *darc.Darc,
+// AddSigner evolves a Reader or Garage Darc so that newSigner becomes one of
+// its members
+func (c *Client) AddSigner(d *darc.Darc,
 	newSigner darc.Signer, signer darc.Signer) (*darc.Darc, error){
 
 	if !(bytes.Equal(d.Description, []byte("Reader darc")) || bytes.Equal(d.Description, []byte("Garage darc"))) {
@@ -217,13 +232,13 @@ func (s *ser) addSigner(d *darc.Darc,
 	}
 	//updating the sign expression
 	oldExp := d.Rules.GetSignExpr()
-	exp, err := addSignerToExpr(oldExp, newSigner)
+	exp, err := addSignerToExpr(oldExp, newSigner.Identity().String())
 	if err != nil {
 		return nil, err
 	}
 	d2.Rules.UpdateSign([]byte(exp))
 
-	pr,err := s.evolveDarc(d2, signer)
+	pr,err := c.EvolveDarc(d2, signer)
 	if err != nil {
 		return nil, err
 	}
@@ -246,64 +261,97 @@ func (s *ser) addSigner(d *darc.Darc,
 	return d2, err
 }
 
-// Creating the Expression When a new Member(Reader/Garage) is added
-// to have the format
+// addSignerToExpr returns the sign expression with the new member, in the
+// format
 // (Pub_m1 | Pub_m2 | ...) & DarcUser
+func addSignerToExpr(oldExp expression.Expr, newMember string) (expression.Expr, error){
 
-func addSignerToExpr(oldExp expression.Expr, newMember darc.Signer) (expression.Expr, error){
-
-	exp := ""
-	var err error
-	//if there is only one Identity in the expression
-	if !(strings.Contains(string(oldExp), "&")){
-		exp = string(oldExp) + " & " + newMember.Identity().String()
-		return []byte(exp), err
-	}
-
-	//otherwise split the expression into members connected with OR (Pub_m1 | Pub_m2 | ...)
-	//and the Darc of the user that owns the Car and then add a new  Pub_m_n
-	dPart := ""
-	otherPart := ""
-	oldExpStr := strings.Split(string(oldExp), "&")
-
-	//checking which part of the expression contains the darc Identity
-	if strings.Contains(oldExpStr[0], "darc"){
-		dPart = removeSpace(oldExpStr[0])
-		otherPart = removeSpace(oldExpStr[1])
+	user, members, err := parseMembersExpr(oldExp)
+	if err != nil {
+		return nil, err
 	}
-	if strings.Contains(oldExpStr[1], "darc"){
-		dPart = removeSpace(oldExpStr[1])
-		otherPart = removeSpace(oldExpStr[0])
+	if !validIdentity(newMember) {
+		return nil, errors.New("invalid member")
 	}
-
-	if strings.Contains(otherPart, "("){
-		temp:= strings.Split(otherPart, ")")
-		otherPart = removeSpace(temp[0]) + " | " + newMember.Identity().String() + ")"
+	if newMember == user {
+		return oldExp, nil
 	}
-	if !(strings.Contains(otherPart, "(")){
-		otherPart = "(" + otherPart + " | " + newMember.Identity().String() + ")"
+	for _, m := range members {
+		if m == newMember {
+			return oldExp, nil
+		}
 	}
+	return membersExpr(user, append(members, newMember)), nil
+}
+
+// parseMembersExpr returns the identity of the user and the members of a
+// sign expression of the form DarcUser, DarcUser & Pub_m1 or
+// (Pub_m1 | Pub_m2 | ...) & DarcUser. Any other expression, like the OR of
+// ANDs of a threshold, is refused, as the members can't be changed without
+// changing its meaning.
+func parseMembersExpr(exp expression.Expr) (string, []string, error) {
+	parts := strings.Split(string(exp), "&")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	switch {
+	case len(parts) == 1 && validIdentity(parts[0]):
+		return parts[0], nil, nil
+	case len(parts) != 2:
+		return "", nil, errors.New("invalid expression")
+	case validIdentity(parts[0]) && validIdentity(parts[1]):
+		//the user is the darc, or the first identity if both are darcs
+		if !strings.HasPrefix(parts[0], "darc:") && strings.HasPrefix(parts[1], "darc:") {
+			return parts[1], []string{parts[0]}, nil
+		}
+		return parts[0], []string{parts[1]}, nil
+	case validIdentity(parts[1]):
+		members, err := parseOrMembers(parts[0])
+		return parts[1], members, err
+	case validIdentity(parts[0]):
+		members, err := parseOrMembers(parts[1])
+		return parts[0], members, err
+	}
+	return "", nil, errors.New("invalid expression")
+}
 
-	if dPart == "" || otherPart == ""{
+// parseOrMembers returns the members of (Pub_m1 | Pub_m2 | ...)
+func parseOrMembers(part string) ([]string, error) {
+	if !strings.HasPrefix(part, "(") || !strings.HasSuffix(part, ")") {
 		return nil, errors.New("invalid expression")
 	}
-
-	exp = removeSpace(otherPart) + " & " + removeSpace(dPart)
-	return []byte(exp), err
-
+	var members []string
+	for _, m := range strings.Split(part[1:len(part)-1], "|") {
+		m = strings.TrimSpace(m)
+		if !validIdentity(m) {
+			return nil, errors.New("invalid expression")
+		}
+		members = append(members, m)
+	}
+	return members, nil
 }
 
-func removeSpace(str string) (string) {
-	if strings.HasSuffix(str, " ") {
-		str = strings.TrimSuffix(str, " ")
+// membersExpr returns the sign expression of the user and the members
+func membersExpr(user string, members []string) expression.Expr {
+	switch len(members) {
+	case 0:
+		return expression.Expr(user)
+	case 1:
+		return expression.InitAndExpr(user, members[0])
 	}
-	if strings.HasPrefix(str, " ") {
-		str = strings.TrimPrefix(str, " ")
-	}
-	return str
+	return expression.Expr("(" + string(expression.InitOrExpr(members...)) + ") & " + user)
+}
+
+// validIdentity returns whether the string is a single identity, and not an
+// expression
+func validIdentity(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "()&| \t")
 }
 
-func (s *ser) evolveDarc(d2 *darc.Darc, signer darc.Signer) (*byzcoin.Proof, error) {
+// EvolveDarc sends the evolved darc d2 to ByzCoin and returns the proof of
+// its inclusion. The signers must fulfil the invoke:evolve rule of the darc,
+// all the members of a threshold must sign.
+func (c *Client) EvolveDarc(d2 *darc.Darc, signers ...darc.Signer) (*byzcoin.Proof, error) {
 	d2Buf, err := d2.ToProto()
 	if err != nil {
 		return nil, err
@@ -327,7 +375,7 @@ func (s *ser) evolveDarc(d2 *darc.Darc, signer darc.Signer) (*byzcoin.Proof, err
 	ctx := byzcoin.ClientTransaction{
 		Instructions: []byzcoin.Instruction{instr}}
 
-	pr,err := s.signAndSendTransaction(ctx, signer, d2, d2.GetBaseID())
+	pr,err := c.signAndSend(ctx, d2, d2.GetBaseID(), signers)
 	if err != nil {
 		return nil, err
 	}
@@ -355,24 +403,32 @@ func newSpawnDarcTransaction(controlDarc *darc.Darc, newDarcBuf []byte) byzcoin.
 	return ctx
 }
 
-//Signing and sending a transaction to ByzCoin and waiting for it to be included in the ledger
-func (s *ser)signAndSendTransaction(ctx byzcoin.ClientTransaction, txnSigner darc.Signer,
+// SignAndSendTransaction signs the first instruction of the transaction,
+// sends it to ByzCoin and waits for it to be included in the ledger
+func (c *Client) SignAndSendTransaction(ctx byzcoin.ClientTransaction, txnSigner darc.Signer,
 	controlDarc *darc.Darc, instanceKey []byte) (*byzcoin.Proof, error) {
+	return c.signAndSend(ctx, controlDarc, instanceKey, []darc.Signer{txnSigner})
+}
+
+// signAndSend signs the first instruction of the transaction with all the
+// signers, sends it to ByzCoin and waits for it to be included in the ledger
+func (c *Client) signAndSend(ctx byzcoin.ClientTransaction, controlDarc *darc.Darc,
+	instanceKey []byte, signers []darc.Signer) (*byzcoin.Proof, error) {
 
-	// Sign the instruction with the signer that has his
-	// public key stored in the darc.
-	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), txnSigner)
+	// Sign the instruction with the signers that have their
+	// public keys stored in the darc.
+	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
 	if err != nil {
 		return nil, err
 	}
 	// Sending this transaction to ByzCoin and waiting for it to be included
 	// in the ledger, up to a maximum of 5 block intervals
-	_, err = s.cl.AddTransactionAndWait(ctx, 5)
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
 	if err != nil {
 		return nil, err
 	}
 	//GetProof returns a proof for the key stored in the skipchain
-	resp, err := s.cl.GetProof(instanceKey)
+	resp, err := c.ByzCoin.GetProof(instanceKey)
 	if err != nil {
 		return nil, err
 	}
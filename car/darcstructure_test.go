@@ -3,6 +3,7 @@ package car
 import (
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -14,58 +15,59 @@ func TestService_DarcStructure(t *testing.T) {
 
 	//creating admin and admin darc
 	admin := darc.NewSignerEd25519(nil, nil)
-	ctx, darcAdmin, err := spawnAdminDarc(s.gDarc, admin)
+	ctx, darcAdmin, err := SpawnAdminDarc(s.gDarc, admin)
 	require.Nil(t,err)
-	_, err = s.signAndSendTransaction(ctx, s.signer, s.gDarc, byzcoin.NewInstanceID(darcAdmin.GetBaseID()).Slice())
+	_, err = s.client.SignAndSendTransaction(ctx, s.signer, s.gDarc, byzcoin.NewInstanceID(darcAdmin.GetBaseID()).Slice())
 	require.Nil(t,err)
 
 	//creating user and user darc
 	user := darc.NewSignerEd25519(nil, nil)
-	ctx, darcUser,err := spawnDarc(darcAdmin, user.Identity().String(), "User")
+	ctx, darcUser,err := SpawnDarc(darcAdmin, user.Identity().String(), "User")
 	require.Nil(t,err)
-	_, err = s.signAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcUser.GetBaseID()).Slice())
+	_, err = s.client.SignAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcUser.GetBaseID()).Slice())
 	require.Nil(t,err)
 
 	//creating reader darc with rules initialized with the user darc
-	ctx, darcReader,err := spawnDarc(darcAdmin, darcUser.GetIdentityString(), "Reader")
+	ctx, darcReader,err := SpawnDarc(darcAdmin, darcUser.GetIdentityString(), "Reader")
 	require.Nil(t,err)
-	_, err = s.signAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcReader.GetBaseID()).Slice())
+	_, err = s.client.SignAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcReader.GetBaseID()).Slice())
 	require.Nil(t,err)
 
 	//creating garage darc with rules initialized with the user darc
-	ctx, darcGarage,err := spawnDarc(darcAdmin, darcUser.GetIdentityString(), "Garage")
+	ctx, darcGarage,err := SpawnDarc(darcAdmin, darcUser.GetIdentityString(), "Garage")
 	require.Nil(t,err)
-	_, err = s.signAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcGarage.GetBaseID()).Slice())
+	_, err = s.client.SignAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcGarage.GetBaseID()).Slice())
 	require.Nil(t,err)
+	s.certifyGarage(t, darcGarage)
 
 	//create car darc
-	ctx, darcCar,err := spawnCarDarc(darcAdmin, darcReader, darcGarage)
+	ctx, darcCar,err := SpawnCarDarc(darcAdmin, darcUser, darcReader, darcGarage)
 	require.Nil(t,err)
-	_, err = s.signAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcCar.GetBaseID()).Slice())
+	_, err = s.client.SignAndSendTransaction(ctx, admin, darcAdmin, byzcoin.NewInstanceID(darcCar.GetBaseID()).Slice())
 	require.Nil(t,err)
 
 	//evolve the reader darc by adding a new reader
 	newReader := darc.NewSignerEd25519(nil, nil)
-	evolved_darc, err := s.addSigner(darcReader, newReader, user)
+	evolved_darc, err := s.client.AddSigner(darcReader, newReader, user)
 	require.Nil(t,err)
 
 	//add a new reader
 	newReader2 := darc.NewSignerEd25519(nil, nil)
-	evolved_darc2, err := s.addSigner(evolved_darc, newReader2, user)
+	evolved_darc2, err := s.client.AddSigner(evolved_darc, newReader2, user)
 	require.Nil(t,err)
 
 	//remove the second reader
-	_, err = s.removeSigner(evolved_darc2, newReader2, user)
+	_, err = s.client.RemoveSigner(evolved_darc2, newReader2, user)
 	require.Nil(t,err)
 
 	//evolve the garage darc by adding a new garage person
 	newGarage := darc.NewSignerEd25519(nil, nil)
-	_, err = s.addSigner(darcGarage, newGarage, user)
+	_, err = s.client.AddSigner(darcGarage, newGarage, user)
 	require.Nil(t,err)
 
 	//create a car object and then spawn a car instance
-	car := NewCar("123A2314")
-	cInstance, err := s.createCarInstance(car,
+	car := NewCar("1M8GDM9AXKP042788")
+	cInstance, err := s.client.CreateCarInstance(car,
 		darcCar, admin)
 	require.Nil(t, err)
 
@@ -74,17 +76,66 @@ func TestService_DarcStructure(t *testing.T) {
 	require.Nil(t, err)
 
 	//adding report for the car instance
-	var wData SecretData
-	wData.ECOScore = "2310"
-	wData.Mileage = "100 000"
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	wData.ECOScore = 2310
 	wData.Warranty = true
 
-	s.addReport(cInstance,
-		darcCar, wData, newGarage, user)
+	s.client.AddReport(cInstance,
+		darcCar, wData, nil, newGarage, user)
 
 	//reading the reports for the car instance
-	secrets, err := s.readReports(cInstance, darcCar, newReader, user)
+	secrets, err := s.client.ReadReports(cInstance, darcCar, newReader, user)
 	require.Nil(t, err)
 
 	require.Equal(t, secrets[0].Mileage, wData.Mileage)
 }
+
+func TestAddSignerToExpr(t *testing.T) {
+	exp, err := addSignerToExpr(expression.Expr("darc:user"), "ed25519:a")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("darc:user & ed25519:a"), exp)
+	exp, err = addSignerToExpr(exp, "ed25519:b")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("(ed25519:a | ed25519:b) & darc:user"), exp)
+	exp, err = addSignerToExpr(exp, "darc:c")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("(ed25519:a | ed25519:b | darc:c) & darc:user"), exp)
+
+	//a member is only added once
+	exp, err = addSignerToExpr(exp, "ed25519:b")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("(ed25519:a | ed25519:b | darc:c) & darc:user"), exp)
+
+	//the OR of ANDs of a threshold is refused
+	threshold, err := ThresholdExpr(2, "ed25519:a", "ed25519:b", "darc:c")
+	require.Nil(t, err)
+	_, err = addSignerToExpr(threshold, "ed25519:d")
+	require.NotNil(t, err)
+	_, err = addSignerToExpr(expression.Expr("(ed25519:a & ed25519:b) & darc:user"), "ed25519:d")
+	require.NotNil(t, err)
+	_, err = addSignerToExpr(expression.Expr("darc:user"), "(ed25519:d | ed25519:e)")
+	require.NotNil(t, err)
+}
+
+func TestRemoveSignerFromExpr(t *testing.T) {
+	exp, err := removeSignerFromExpr(expression.Expr("(ed25519:a | ed25519:b | darc:c) & darc:user"), "ed25519:b")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("(ed25519:a | darc:c) & darc:user"), exp)
+	exp, err = removeSignerFromExpr(exp, "ed25519:a")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("darc:user & darc:c"), exp)
+	exp, err = removeSignerFromExpr(exp, "darc:c")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("darc:user"), exp)
+
+	//the member of an identity containing the removed one stays
+	exp, err = removeSignerFromExpr(expression.Expr("ed25519:ab & darc:user"), "ed25519:a")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("ed25519:ab & darc:user"), exp)
+
+	//the OR of ANDs of a threshold is refused
+	threshold, err := ThresholdExpr(2, "ed25519:a", "ed25519:b", "darc:c")
+	require.Nil(t, err)
+	_, err = removeSignerFromExpr(threshold, "ed25519:a")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,341 @@
+package car
+
+/*
+The disclosure.go lets a garage encrypt every group of fields of the secret
+of a report in its own Calypso write, listed in Report.FieldWrites. The
+readers of the car darc can read all of them, and the owner can let other
+darcs read only some groups: the command read<Field> of the car contract,
+like readMileage, spawns the read instance of the write of the field and is
+protected by its own rule of the car darc, which the owner sets with
+discloseField.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// FieldReadCommand returns the command of the car contract reading the
+// writes of the field, which is also the action of its rule. The command is
+// matched by the contract, so only the first ASCII letter of the field is
+// put in upper case.
+func FieldReadCommand(field string) string {
+	if field == "" || field[0] < 'a' || field[0] > 'z' {
+		return "read" + field
+	}
+	return "read" + string(field[0]-'a'+'A') + field[1:]
+}
+
+// fieldOfCommand returns the field read by the command, if it is one of the
+// FieldReadCommand
+func fieldOfCommand(command string) (string, bool) {
+	for _, field := range SecretFields {
+		if FieldReadCommand(field) == command {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// validateWrites checks that the secret of the report is either in one
+// write or in one write for each of the SecretFields
+func validateWrites(r Report) error {
+	if len(r.FieldWrites) == 0 {
+		return nil
+	}
+	if len(r.WriteInstanceID) != 0 {
+		return errors.New("the secret is either in one write or in the writes of its fields")
+	}
+	if len(r.FieldWrites) != len(SecretFields) {
+		return errors.New("need one write for each field of the secret")
+	}
+	for i, field := range SecretFields {
+		if r.FieldWrites[i].Field != field {
+			return errors.New("the writes of the fields must follow SecretFields")
+		}
+	}
+	return nil
+}
+
+// verifyWrites checks that the writes of the report are Calypso writes of
+// the car darc, so that a report can't point to the secrets of another car
+func verifyWrites(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID, r Report) error {
+	for _, writeID := range reportWriteIDs([]Report{r}) {
+		if len(writeID) == 0 {
+			continue
+		}
+		_, contractID, writeDarcID, err := cdb.GetValues(writeID)
+		if err != nil {
+			return err
+		}
+		if contractID != calypso.ContractWriteID || !writeDarcID.Equal(carDarcID) {
+			return errors.New("the writes of the report must be calypso writes of the car")
+		}
+	}
+	return nil
+}
+
+// ReadField spawns the Calypso read instance in the "read" argument, which
+// must read the write of the field of the report with the index in the
+// "index" argument. The car isn't changed, so the read instance is the only
+// state change of the instruction.
+func (car *Car) ReadField(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	carDarcID darc.ID, field string) ([]byzcoin.StateChange, error) {
+
+	args := inst.Invoke.Args
+	readBuf := args.Search("read")
+	var read calypso.Read
+	err := protobuf.DecodeWithConstructors(readBuf, &read, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("not a calypso read")
+	}
+	indexBuf := args.Search("index")
+	if len(indexBuf) != 4 {
+		return nil, errors.New("need the index of the report")
+	}
+	index := binary.LittleEndian.Uint32(indexBuf)
+	if index >= car.ReportCount {
+		return nil, errors.New("no report with this index")
+	}
+	r, err := loadReport(cdb, inst.InstanceID, index)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, fw := range r.FieldWrites {
+		if fw.Field == field && string(fw.WriteInstanceID) == string(read.Write.Slice()) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("the write is not the " + field + " of the report")
+	}
+	_, contractID, writeDarcID, err := cdb.GetValues(read.Write.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if contractID != calypso.ContractWriteID || !writeDarcID.Equal(carDarcID) {
+		return nil, errors.New("only the writes of the car can be read")
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+			calypso.ContractReadID, readBuf, writeDarcID),
+	}, nil
+}
+
+// DiscloseField evolves the car darc so that the darcs in the "reader"
+// arguments can read the field given in the "field" argument, besides the
+// readers of the car. Without reader, only the readers of the car can read
+// the field.
+func (car *Car) DiscloseField(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	field := string(args.Search("field"))
+	if _, ok := fieldOfCommand(FieldReadCommand(field)); !ok {
+		return nil, errors.New("unknown field of the secret data")
+	}
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return nil, err
+	}
+	readers := []string{string(carDarc.Rules.Get("spawn:calypsoRead"))}
+	for _, arg := range args {
+		if arg.Name != "reader" {
+			continue
+		}
+		_, contractID, _, err := cdb.GetValues(arg.Value)
+		if err != nil {
+			return nil, err
+		}
+		if contractID != byzcoin.ContractDarcID {
+			return nil, errors.New("the readers must be darcs")
+		}
+		readers = append(readers, darc.NewIdentityDarc(arg.Value).String())
+	}
+
+	return evolveRule(carDarc, darc.Action("invoke:"+FieldReadCommand(field)),
+		expression.InitOrExpr(readers...))
+}
+
+// darcRule is a rule of the car darc to add or to replace
+type darcRule struct {
+	action darc.Action
+	expr   expression.Expr
+}
+
+// evolveRule returns the state change evolving the car darc, where the rule
+// of the action is added or replaced by the expression
+func evolveRule(carDarc *darc.Darc, action darc.Action, expr expression.Expr) ([]byzcoin.StateChange, error) {
+	return evolveRules(carDarc, []darcRule{{action, expr}})
+}
+
+// evolveRules returns the state change evolving the car darc, where all the
+// rules are added or replaced
+func evolveRules(carDarc *darc.Darc, rules []darcRule) ([]byzcoin.StateChange, error) {
+	newDarc := carDarc.Copy()
+	err := newDarc.EvolveFrom(carDarc)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if newDarc.Rules.Contains(r.action) {
+			err = newDarc.Rules.UpdateRule(r.action, r.expr)
+		} else {
+			err = newDarc.Rules.AddRule(r.action, r.expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	newDarcBuf, err := newDarc.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, byzcoin.NewInstanceID(carDarc.GetBaseID()),
+			byzcoin.ContractDarcID, newDarcBuf, carDarc.GetBaseID()),
+	}, nil
+}
+
+// AddReportByField adds a report like AddReport, but encrypts each group of
+// fields of wData in its own Calypso write, so that they can be disclosed
+// separately.
+func (c *Client) AddReportByField(instID byzcoin.InstanceID,
+	controlDarc *darc.Darc, wData SecretData, previous *SecretData,
+	signerG darc.Signer, signerO darc.Signer) error {
+
+	var newReport Report
+	err := newReport.CommitMileage(&wData, previous)
+	if err != nil {
+		return err
+	}
+	ctx := byzcoin.ClientTransaction{}
+	for i, field := range SecretFields {
+		part, err := wData.Part(field)
+		if err != nil {
+			return err
+		}
+		partBuf, err := EncodeSecretPart(&part, field)
+		if err != nil {
+			return err
+		}
+		key := random.Bits(128, true, random.New())
+		writeBuf, err := newEncryptedWrite(key, partBuf, controlDarc.GetBaseID(), c.LTS)
+		if err != nil {
+			return err
+		}
+		instr := newWriteInstruction(controlDarc.GetBaseID(), writeBuf)
+		instr.Index = i
+		instr.Length = len(SecretFields)
+		ctx.Instructions = append(ctx.Instructions, instr)
+	}
+	for i := range ctx.Instructions {
+		err = ctx.Instructions[i].SignBy(controlDarc.GetBaseID(), signerG, signerO)
+		if err != nil {
+			return err
+		}
+		newReport.FieldWrites = append(newReport.FieldWrites, FieldWrite{
+			Field:           SecretFields[i],
+			WriteInstanceID: ctx.Instructions[i].DeriveID("").Slice(),
+		})
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	if err != nil {
+		return err
+	}
+	return c.sendNewReport(instID, controlDarc, newReport, wData.Kind, signerG, signerO)
+}
+
+// DiscloseField lets the readers, besides the readers of the car, read the
+// field of the reports added with AddReportByField. The signers must fulfil
+// the invoke:discloseField rule of the car darc, which is returned after its
+// evolution.
+func (c *Client) DiscloseField(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	field string, readers []darc.ID, signers ...darc.Signer) (*darc.Darc, error) {
+
+	args := byzcoin.Arguments{{Name: "field", Value: []byte(field)}}
+	for _, reader := range readers {
+		args = append(args, byzcoin.Argument{Name: "reader", Value: reader})
+	}
+	err := c.sendCarCommand(instID, controlDarc, "discloseField", args, signers...)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetDarc(controlDarc.GetBaseID())
+}
+
+// ReadReportField returns the parts of the secrets of the effective history
+// of the car holding the field, for the reports added with AddReportByField.
+// The parts are re-encrypted to signerR, which must fulfil the rule of the
+// FieldReadCommand of the field with the other signers.
+func (c *Client) ReadReportField(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	field string, signerR darc.Signer, signers ...darc.Signer) ([]SecretData, error) {
+
+	xc, err := readerPoint(signerR)
+	if err != nil {
+		return nil, err
+	}
+	carData, err := c.GetCar(instID)
+	if err != nil {
+		return nil, err
+	}
+	trail, err := c.GetReportsPage(instID, 0, carData.ReportCount)
+	if err != nil {
+		return nil, err
+	}
+	signers = append([]darc.Signer{signerR}, signers...)
+	//the writes of the reports of the effective history
+	effective := map[string]bool{}
+	for _, r := range EffectiveReports(trail) {
+		for _, fw := range r.FieldWrites {
+			effective[string(fw.WriteInstanceID)] = true
+		}
+	}
+	//reading the writes of the field of all the reports in one transaction
+	var writeIDs [][]byte
+	var args []byzcoin.Arguments
+	for i, r := range trail {
+		for _, fw := range r.FieldWrites {
+			if fw.Field != field || !effective[string(fw.WriteInstanceID)] {
+				continue
+			}
+			readBuf, err := protobuf.Encode(&calypso.Read{
+				Write: byzcoin.NewInstanceID(fw.WriteInstanceID),
+				Xc:    xc,
+			})
+			if err != nil {
+				return nil, err
+			}
+			index := make([]byte, 4)
+			binary.LittleEndian.PutUint32(index, uint32(i))
+			writeIDs = append(writeIDs, fw.WriteInstanceID)
+			args = append(args, byzcoin.Arguments{{Name: "read", Value: readBuf}, {Name: "index", Value: index}})
+		}
+	}
+	readIDs, err := c.invokeReads(instID, controlDarc.GetBaseID(), FieldReadCommand(field), args, signers)
+	if err != nil {
+		return nil, err
+	}
+	plainTexts, err := c.decryptWrites(writeIDs, readIDs, signerR)
+	if err != nil {
+		return nil, err
+	}
+	var parts []SecretData
+	for _, plainText := range plainTexts {
+		part, err := DecodeSecretPart(plainText, field)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, *part)
+	}
+	return parts, nil
+}
@@ -0,0 +1,19 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldReadCommand(t *testing.T) {
+	require.Equal(t, "readMileage", FieldReadCommand(FieldMileage))
+	require.Equal(t, "readNotes", FieldReadCommand(FieldNotes))
+	for _, field := range SecretFields {
+		f, ok := fieldOfCommand(FieldReadCommand(field))
+		require.True(t, ok)
+		require.Equal(t, field, f)
+	}
+	_, ok := fieldOfCommand("readOwner")
+	require.False(t, ok)
+}
@@ -0,0 +1,306 @@
+package car
+
+/*
+The fleet.go lets fleet customers manage many cars at once. RegisterFleet
+spawns the darcs and the instances of many VINs, all owned by one fleet
+darc, in transactions of FleetBatchSize instructions. GrantFleetAccess and
+RevokeFleetAccess change the reader or the garage of all the cars of the
+fleet with the grantAccess and revokeAccess commands of the car contract.
+ByzCoin refuses a transaction as a whole if one of its instructions fails,
+so the instructions of a refused transaction are sent again one by one, and
+every operation returns the result of each car.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+)
+
+// FleetBatchSize is the number of instructions sent in one transaction by
+// the fleet operations.
+const FleetBatchSize = 50
+
+// The roles of the car darc which can be given to another darc with
+// grantAccess.
+const (
+	RoleReader = "reader"
+	RoleGarage = "garage"
+)
+
+// FleetResult is the outcome of a fleet operation for one car.
+type FleetResult struct {
+	Vin        string
+	InstanceID byzcoin.InstanceID
+	// CarDarc is the darc of the car, only set by RegisterFleet
+	CarDarc *darc.Darc
+	// Err is nil if the operation succeeded for this car
+	Err error
+}
+
+// GrantAccess gives the role in the "role" argument, RoleReader or
+// RoleGarage, to the darc in the "darc" argument, in place of the current
+// reader or garage of the car.
+func (car *Car) GrantAccess(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	darcID := darc.ID(args.Search("darc"))
+	_, contractID, _, err := cdb.GetValues(darcID)
+	if err != nil {
+		return nil, err
+	}
+	if contractID != byzcoin.ContractDarcID {
+		return nil, errors.New("the role can only be given to a darc")
+	}
+	return car.setRole(cdb, carDarcID, string(args.Search("role")), darc.NewIdentityDarc(darcID).String())
+}
+
+// RevokeAccess gives the role in the "role" argument back to the owner of
+// the car, so that the former reader or garage loses its access.
+func (car *Car) RevokeAccess(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	if car.Owner == "" {
+		return nil, errors.New("the car has no owner to give the role back to")
+	}
+	return car.setRole(cdb, carDarcID, string(args.Search("role")), car.Owner)
+}
+
+// setRole evolves the car darc so that the identity is the only reader or
+// the only garage of the car
+func (car *Car) setRole(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID,
+	role string, id string) ([]byzcoin.StateChange, error) {
+
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return nil, err
+	}
+	var rules []darcRule
+	switch role {
+	case RoleReader:
+		rules = append(rules, darcRule{"spawn:calypsoRead", expression.InitAndExpr(id)})
+		for _, field := range SecretFields {
+			rules = append(rules, darcRule{darc.Action("invoke:" + FieldReadCommand(field)),
+				expression.InitAndExpr(id)})
+		}
+	case RoleGarage:
+		//the admin and the new garage can amend and retract the reports
+		amenders := expression.InitOrExpr(string(carDarc.Rules.Get("spawn:car")), id)
+		rules = []darcRule{
+			{"invoke:addReport", expression.InitAndExpr(id)},
+			{"spawn:calypsoWrite", expression.InitAndExpr(id)},
+			{"invoke:amendReport", amenders},
+			{"invoke:retractReport", amenders},
+		}
+	default:
+		return nil, errors.New("the role must be the reader or the garage")
+	}
+	return evolveRules(carDarc, rules)
+}
+
+// RegisterFleet spawns a darc and an instance for each VIN, owned by the
+// fleet darc and with the reader and garage darcs, and returns the result of
+// each VIN in the same order. The signer must fulfil the spawn:darc rule of
+// the admin darc, which becomes the admin of the cars.
+func (c *Client) RegisterFleet(darcAdmin *darc.Darc, darcFleet *darc.Darc, darcReader *darc.Darc,
+	darcGarage *darc.Darc, vins []string, signer darc.Signer) []FleetResult {
+
+	results := make([]FleetResult, len(vins))
+	seen := map[string]bool{}
+	var todo []int
+	for i, vin := range vins {
+		results[i].Vin = NormalizeVin(vin)
+		if results[i].Err = ValidateVin(results[i].Vin); results[i].Err != nil {
+			continue
+		}
+		if seen[results[i].Vin] {
+			results[i].Err = errors.New("the VIN is more than once in the fleet")
+			continue
+		}
+		seen[results[i].Vin] = true
+		resp, err := c.ByzCoin.GetProof(VinInstanceID(results[i].Vin).Slice())
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if resp.Proof.InclusionProof.Match(VinInstanceID(results[i].Vin).Slice()) {
+			results[i].Err = errors.New("the VIN is already registered")
+			continue
+		}
+		todo = append(todo, i)
+	}
+
+	//spawning the darcs of the cars, which need a different description
+	var instrs []byzcoin.Instruction
+	var darcIDs []darc.ID
+	for _, i := range todo {
+		carDarc := newCarDarc(darcAdmin, darcFleet, darcReader, darcGarage, "Car darc "+results[i].Vin)
+		carDarcBuf, err := carDarc.ToProto()
+		if err != nil {
+			panic("a new darc should always be encoded: " + err.Error())
+		}
+		results[i].CarDarc = carDarc
+		instrs = append(instrs, newSpawnDarcTransaction(darcAdmin, carDarcBuf).Instructions[0])
+		darcIDs = append(darcIDs, darcAdmin.GetBaseID())
+	}
+	_, errs := c.sendBatches(instrs, darcIDs, signer)
+	todo = c.keepSucceeded(results, todo, errs)
+
+	//spawning the car instances
+	instrs, darcIDs = nil, nil
+	for _, i := range todo {
+		car := NewCar(results[i].Vin)
+		instr, err := newCarInstruction(car, results[i].CarDarc.GetBaseID())
+		if err != nil {
+			panic("a new car should always be encoded: " + err.Error())
+		}
+		instrs = append(instrs, instr)
+		darcIDs = append(darcIDs, results[i].CarDarc.GetBaseID())
+	}
+	sent, errs := c.sendBatches(instrs, darcIDs, signer)
+	for j, i := range todo {
+		if errs[j] == nil {
+			//the ID covers the index, the length and the signatures of the
+			//instruction as it was sent
+			results[i].InstanceID = sent[j].DeriveID("")
+		}
+	}
+	c.keepSucceeded(results, todo, errs)
+	return results
+}
+
+// GrantFleetAccess gives the role, RoleReader or RoleGarage, of all the cars
+// to the darc, and returns the result of each car in the same order. The
+// signers must fulfil the invoke:grantAccess rule of the car darcs.
+func (c *Client) GrantFleetAccess(cars []byzcoin.InstanceID, role string, darcID darc.ID,
+	signers ...darc.Signer) []FleetResult {
+
+	return c.sendFleetCommand(cars, "grantAccess", byzcoin.Arguments{
+		{Name: "role", Value: []byte(role)},
+		{Name: "darc", Value: darcID},
+	}, signers)
+}
+
+// RevokeFleetAccess gives the role, RoleReader or RoleGarage, of all the
+// cars back to their owner, and returns the result of each car in the same
+// order. The signers must fulfil the invoke:revokeAccess rule of the car
+// darcs.
+func (c *Client) RevokeFleetAccess(cars []byzcoin.InstanceID, role string,
+	signers ...darc.Signer) []FleetResult {
+
+	return c.sendFleetCommand(cars, "revokeAccess", byzcoin.Arguments{
+		{Name: "role", Value: []byte(role)},
+	}, signers)
+}
+
+// sendFleetCommand invokes the command with the arguments on all the cars
+func (c *Client) sendFleetCommand(cars []byzcoin.InstanceID, command string,
+	args byzcoin.Arguments, signers []darc.Signer) []FleetResult {
+
+	results := make([]FleetResult, len(cars))
+	var todo []int
+	var instrs []byzcoin.Instruction
+	var darcIDs []darc.ID
+	for i, instID := range cars {
+		results[i].InstanceID = instID
+		resp, err := c.ByzCoin.GetProof(instID.Slice())
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		_, _, contractID, carDarcID, err := resp.Proof.KeyValue()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if contractID != ContractCarID {
+			results[i].Err = errors.New("not a car instance")
+			continue
+		}
+		car, err := c.GetCar(instID)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Vin = car.Vin
+		todo = append(todo, i)
+		instrs = append(instrs, byzcoin.Instruction{
+			InstanceID: instID,
+			Nonce:      byzcoin.GenNonce(),
+			Invoke: &byzcoin.Invoke{
+				Command: command,
+				Args:    args,
+			},
+		})
+		darcIDs = append(darcIDs, carDarcID)
+	}
+	_, errs := c.sendBatches(instrs, darcIDs, signers...)
+	c.keepSucceeded(results, todo, errs)
+	return results
+}
+
+// keepSucceeded sets the errors of the results in todo and returns the
+// indexes of todo which succeeded
+func (c *Client) keepSucceeded(results []FleetResult, todo []int, errs []error) []int {
+	var succeeded []int
+	for j, i := range todo {
+		if errs[j] != nil {
+			results[i].Err = errs[j]
+			continue
+		}
+		succeeded = append(succeeded, i)
+	}
+	return succeeded
+}
+
+// sendBatches sends the instructions in transactions of at most
+// FleetBatchSize instructions, each signed for the darc with the same index.
+// The instructions of a refused transaction are sent again one by one. It
+// returns the instructions as they were signed and sent, and the error of
+// each instruction.
+func (c *Client) sendBatches(instrs []byzcoin.Instruction, darcIDs []darc.ID,
+	signers ...darc.Signer) ([]byzcoin.Instruction, []error) {
+
+	sent := make([]byzcoin.Instruction, len(instrs))
+	errs := make([]error, len(instrs))
+	for start := 0; start < len(instrs); start += FleetBatchSize {
+		end := start + FleetBatchSize
+		if end > len(instrs) {
+			end = len(instrs)
+		}
+		batch, err := c.sendBatch(instrs[start:end], darcIDs[start:end], signers)
+		if err == nil || end-start == 1 {
+			copy(sent[start:end], batch)
+			errs[start] = err
+			continue
+		}
+		for i := start; i < end; i++ {
+			batch, errs[i] = c.sendBatch(instrs[i:i+1], darcIDs[i:i+1], signers)
+			copy(sent[i:i+1], batch)
+		}
+	}
+	return sent, errs
+}
+
+// sendBatch signs the instructions and sends them in one transaction, and
+// returns the signed instructions
+func (c *Client) sendBatch(instrs []byzcoin.Instruction, darcIDs []darc.ID,
+	signers []darc.Signer) ([]byzcoin.Instruction, error) {
+
+	ctx := byzcoin.ClientTransaction{}
+	for i := range instrs {
+		instr := instrs[i]
+		instr.Index = i
+		instr.Length = len(instrs)
+		instr.Signatures = nil
+		err := instr.SignBy(darcIDs[i], signers...)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Instructions = append(ctx.Instructions, instr)
+	}
+	_, err := c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return ctx.Instructions, err
+}
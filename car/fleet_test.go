@@ -0,0 +1,19 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCarDarc(t *testing.T) {
+	d := darc.NewDarc(darc.InitRules(nil, nil), []byte("test darc"))
+
+	//the darcs of the cars of a fleet have the same rules, so only their
+	//description keeps them apart
+	d1 := newCarDarc(d, d, d, d, "Car darc 1HGCM82633A004352")
+	d2 := newCarDarc(d, d, d, d, "Car darc 1M8GDM9AXKP042788")
+	require.Equal(t, d1.Rules, d2.Rules)
+	require.NotEqual(t, d1.GetBaseID(), d2.GetBaseID())
+}
@@ -0,0 +1,303 @@
+package car
+
+/*
+The garage.go holds the registry of the certified garages. The registry is a
+single instance at GarageRegistryID, spawned from the genesis darc, so that
+only the ledger administrators choose the authority darc controlling it. The
+authority certifies a garage darc by storing its licence and the period of
+validity at CertifiedGarageID(garage), and can revoke it later. The car
+contract only accepts reports from the garages certified at the time of the
+report.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+)
+
+// ContractGarageRegistryID is the contract of the registry of the certified
+// garages.
+var ContractGarageRegistryID = "garageRegistry"
+
+// ContractCertifiedGarageID is the contract of the entries of the registry,
+// they are only created by the registry contract.
+var ContractCertifiedGarageID = "certifiedGarage"
+
+// GarageRegistryID is the ID of the only instance of the registry.
+var GarageRegistryID = byzcoin.NewInstanceID(garageRegistryHash())
+
+func garageRegistryHash() []byte {
+	h := sha256.Sum256([]byte(ContractGarageRegistryID))
+	return h[:]
+}
+
+// CertifiedGarageID returns the ID of the registry entry of the garage darc.
+func CertifiedGarageID(garageDarcID darc.ID) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractCertifiedGarageID))
+	h.Write(garageDarcID)
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// ContractGarageRegistry spawns the registry from the genesis darc, with the
+// darc in the "authority" argument, or the genesis darc if it is missing, as
+// the darc of the registry. The registry can then be invoked with
+// certifyGarage to add or renew a garage and with revokeGarage to revoke it.
+func ContractGarageRegistry(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	cIn []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+
+	cOut = cIn
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		if inst.Spawn.ContractID != ContractGarageRegistryID {
+			return nil, nil, errors.New("can only spawn the garage registry")
+		}
+		var genesisDarcID darc.ID
+		_, _, genesisDarcID, err = cdb.GetValues(byzcoin.ConfigInstanceID.Slice())
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(inst.InstanceID.Slice(), genesisDarcID) {
+			return nil, nil, errors.New("the garage registry must be spawned from the genesis darc")
+		}
+		if _, _, _, errReg := cdb.GetValues(GarageRegistryID.Slice()); errReg == nil {
+			return nil, nil, errors.New("the garage registry already exists")
+		}
+		authority := darc.ID(inst.Spawn.Args.Search("authority"))
+		if len(authority) == 0 {
+			authority = genesisDarcID
+		}
+		_, err = loadDarc(cdb, authority)
+		if err != nil {
+			return
+		}
+		scs = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, GarageRegistryID,
+				ContractGarageRegistryID, []byte{}, authority),
+		}
+		return
+	case byzcoin.InvokeType:
+		var darcID darc.ID
+		_, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return
+		}
+		var sc byzcoin.StateChange
+		switch inst.Invoke.Command {
+		case "certifyGarage":
+			sc, err = certifyGarage(cdb, darcID, inst.Invoke.Args)
+		case "revokeGarage":
+			sc, err = revokeGarage(cdb, darcID, inst.Invoke.Args)
+		default:
+			err = errors.New("garage registry can only certify and revoke garages")
+		}
+		if err != nil {
+			return
+		}
+		scs = []byzcoin.StateChange{sc}
+		return
+	default:
+		return nil, nil, errors.New("the garage registry can't be deleted")
+	}
+}
+
+// certifyGarage adds or renews the entry of the garage in the "garage"
+// argument
+func certifyGarage(cdb byzcoin.ReadOnlyStateTrie, registryDarcID darc.ID,
+	args byzcoin.Arguments) (byzcoin.StateChange, error) {
+
+	var garage CertifiedGarage
+	err := protobuf.Decode(args.Search("garage"), &garage)
+	if err != nil {
+		return byzcoin.StateChange{}, errors.New("not a certified garage")
+	}
+	if garage.Name == "" || garage.Licence == "" {
+		return byzcoin.StateChange{}, errors.New("need the name and the licence of the garage")
+	}
+	if garage.ValidUntil <= garage.ValidFrom {
+		return byzcoin.StateChange{}, errors.New("the certification must end after it starts")
+	}
+	if garage.Revoked {
+		return byzcoin.StateChange{}, errors.New("use revokeGarage to revoke a garage")
+	}
+	_, err = loadDarc(cdb, garage.GarageDarcID)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	garageBuf, err := protobuf.Encode(&garage)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	action := byzcoin.Create
+	if _, _, _, errEntry := cdb.GetValues(CertifiedGarageID(garage.GarageDarcID).Slice()); errEntry == nil {
+		action = byzcoin.Update
+	}
+	return byzcoin.NewStateChange(action, CertifiedGarageID(garage.GarageDarcID),
+		ContractCertifiedGarageID, garageBuf, registryDarcID), nil
+}
+
+// revokeGarage revokes the entry of the garage darc in the "garage"
+// argument
+func revokeGarage(cdb byzcoin.ReadOnlyStateTrie, registryDarcID darc.ID,
+	args byzcoin.Arguments) (byzcoin.StateChange, error) {
+
+	garage, err := loadCertifiedGarage(cdb, args.Search("garage"))
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if garage.Revoked {
+		return byzcoin.StateChange{}, errors.New("the garage is already revoked")
+	}
+	garage.Revoked = true
+	garageBuf, err := protobuf.Encode(garage)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	return byzcoin.NewStateChange(byzcoin.Update, CertifiedGarageID(garage.GarageDarcID),
+		ContractCertifiedGarageID, garageBuf, registryDarcID), nil
+}
+
+// loadCertifiedGarage returns the registry entry of the garage darc
+func loadCertifiedGarage(cdb byzcoin.ReadOnlyStateTrie, garageDarcID darc.ID) (*CertifiedGarage, error) {
+	buf, contractID, _, err := cdb.GetValues(CertifiedGarageID(garageDarcID).Slice())
+	if err != nil {
+		return nil, errors.New("the garage is not certified")
+	}
+	if contractID != ContractCertifiedGarageID {
+		return nil, errors.New("not a certified garage")
+	}
+	var garage CertifiedGarage
+	err = protobuf.Decode(buf, &garage)
+	if err != nil {
+		return nil, err
+	}
+	return &garage, nil
+}
+
+// ValidAt returns an error if the garage is revoked or if its certification
+// doesn't cover the time t.
+func (g *CertifiedGarage) ValidAt(t time.Time) error {
+	if g.Revoked {
+		return errors.New("the certification of the garage is revoked")
+	}
+	if t.Before(time.Unix(g.ValidFrom, 0)) || !t.Before(time.Unix(g.ValidUntil, 0)) {
+		return errors.New("the garage is not certified at the time of the report")
+	}
+	return nil
+}
+
+// verifyCertified checks that the garage of the report is a darc certified
+// in the registry at the time of the report.
+func verifyCertified(cdb byzcoin.ReadOnlyStateTrie, r Report) error {
+	if !strings.HasPrefix(r.GarageId, "darc:") {
+		return errors.New("the garage of the report must be a single darc")
+	}
+	garageDarcID, err := hex.DecodeString(strings.TrimPrefix(r.GarageId, "darc:"))
+	if err != nil {
+		return errors.New("the garage of the report must be a single darc")
+	}
+	garage, err := loadCertifiedGarage(cdb, garageDarcID)
+	if err != nil {
+		return err
+	}
+	return garage.ValidAt(r.Time())
+}
+
+// CreateGarageRegistry spawns the registry of the certified garages from the
+// genesis darc, controlled by the authority darc. The signers must fulfil the
+// spawn:garageRegistry rule of the genesis darc.
+func (c *Client) CreateGarageRegistry(genesisDarc *darc.Darc, authority darc.ID,
+	signers ...darc.Signer) error {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: byzcoin.NewInstanceID(genesisDarc.GetBaseID()),
+			Nonce:      byzcoin.Nonce{},
+			Index:      0,
+			Length:     1,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractGarageRegistryID,
+				Args:       byzcoin.Arguments{{Name: "authority", Value: authority}},
+			},
+		}},
+	}
+	return c.sendRegistryTransaction(ctx, genesisDarc.GetBaseID(), signers)
+}
+
+// CertifyGarage adds the garage to the registry, or renews its
+// certification. The signers must fulfil the invoke:certifyGarage rule of the
+// authority darc.
+func (c *Client) CertifyGarage(authority *darc.Darc, garage CertifiedGarage,
+	signers ...darc.Signer) error {
+
+	garageBuf, err := protobuf.Encode(&garage)
+	if err != nil {
+		return err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{newRegistryInstruction("certifyGarage", garageBuf)},
+	}
+	return c.sendRegistryTransaction(ctx, authority.GetBaseID(), signers)
+}
+
+// RevokeGarage revokes the certification of the garage darc. The signers
+// must fulfil the invoke:revokeGarage rule of the authority darc.
+func (c *Client) RevokeGarage(authority *darc.Darc, garageDarcID darc.ID,
+	signers ...darc.Signer) error {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{newRegistryInstruction("revokeGarage", garageDarcID)},
+	}
+	return c.sendRegistryTransaction(ctx, authority.GetBaseID(), signers)
+}
+
+// GetCertifiedGarage returns the registry entry of the garage darc.
+func (c *Client) GetCertifiedGarage(garageDarcID darc.ID) (*CertifiedGarage, error) {
+	var garage CertifiedGarage
+	err := c.getInstance(CertifiedGarageID(garageDarcID), ContractCertifiedGarageID, &garage)
+	if err != nil {
+		return nil, err
+	}
+	return &garage, nil
+}
+
+// newRegistryInstruction returns the instruction invoking the command of the
+// garage registry with the "garage" argument
+func newRegistryInstruction(command string, garage []byte) byzcoin.Instruction {
+	return byzcoin.Instruction{
+		InstanceID: GarageRegistryID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    byzcoin.Arguments{{Name: "garage", Value: garage}},
+		},
+	}
+}
+
+// sendRegistryTransaction signs the only instruction of the transaction with
+// the darc and waits for it to be added
+func (c *Client) sendRegistryTransaction(ctx byzcoin.ClientTransaction, darcID darc.ID,
+	signers []darc.Signer) error {
+
+	err := ctx.Instructions[0].SignBy(darcID, signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
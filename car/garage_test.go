@@ -0,0 +1,26 @@
+package car
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertifiedGarage_ValidAt(t *testing.T) {
+	now := time.Now()
+	g := CertifiedGarage{
+		ValidFrom:  now.Add(-time.Hour).Unix(),
+		ValidUntil: now.Add(time.Hour).Unix(),
+	}
+	require.Nil(t, g.ValidAt(now))
+	require.NotNil(t, g.ValidAt(now.Add(-2*time.Hour)))
+	require.NotNil(t, g.ValidAt(now.Add(2*time.Hour)))
+	g.Revoked = true
+	require.NotNil(t, g.ValidAt(now))
+}
+
+func TestCertifiedGarageID(t *testing.T) {
+	require.NotEqual(t, CertifiedGarageID([]byte{1}), CertifiedGarageID([]byte{2}))
+	require.NotEqual(t, GarageRegistryID, CertifiedGarageID(nil))
+}
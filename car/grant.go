@@ -0,0 +1,328 @@
+package car
+
+/*
+The grant.go lets the owner give a prospective buyer access to the reports of
+the car for a limited time, without adding the buyer to the reader darc. The
+owner invokes grantRead on the car, which stores a ReadGrant at
+ReadGrantID(car, reader). The reader then invokes read on the grant instance,
+which spawns the Calypso read instance of a report of the car as long as the
+grant is not expired and the car has the same owner. Once the grant expires
+the reads are refused, the owner doesn't have to revoke it.
+*/
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// ContractReadGrantID is the contract of the read grants, they are only
+// created by the car contract.
+var ContractReadGrantID = "carReadGrant"
+
+// maxReadGrant is the longest time a read grant can be valid
+const maxReadGrant = 30 * 24 * time.Hour
+
+// ReadGrantID returns the ID of the read grant of the reader identity for
+// the car.
+func ReadGrantID(carID byzcoin.InstanceID, reader string) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractReadGrantID))
+	h.Write(carID.Slice())
+	h.Write([]byte(reader))
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// GrantRead stores the read grant in the "grant" argument for the car, or
+// extends the existing grant of the same reader. The grant must expire in
+// the future, in at most maxReadGrant.
+func (car *Car) GrantRead(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	var grant ReadGrant
+	err := protobuf.Decode(args.Search("grant"), &grant)
+	if err != nil {
+		return nil, errors.New("not a read grant")
+	}
+	if grant.Reader == "" {
+		return nil, errors.New("need the identity of the reader")
+	}
+	now := time.Now()
+	expiry := time.Unix(grant.Expiry, 0)
+	if !expiry.After(now) || expiry.After(now.Add(maxReadGrant)) {
+		return nil, errors.New("a read grant must expire in the next 30 days")
+	}
+	grant.CarInstanceID = carID.Slice()
+	grant.Owner = car.Owner
+	car.addGrantReader(grant.Reader)
+	grantBuf, err := protobuf.Encode(&grant)
+	if err != nil {
+		return nil, err
+	}
+	grantID := ReadGrantID(carID, grant.Reader)
+	action := byzcoin.Create
+	if _, _, _, errGrant := cdb.GetValues(grantID.Slice()); errGrant == nil {
+		action = byzcoin.Update
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(action, grantID, ContractReadGrantID, grantBuf, carDarcID),
+	}, nil
+}
+
+// addGrantReader adds the reader to the GrantReaders of the car, if it's not
+// there yet
+func (car *Car) addGrantReader(reader string) {
+	for _, r := range car.GrantReaders {
+		if r == reader {
+			return
+		}
+	}
+	car.GrantReaders = append(car.GrantReaders, reader)
+}
+
+// RevokeRead removes the read grant of the identity in the "reader"
+// argument before it expires.
+func (car *Car) RevokeRead(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	grantID := ReadGrantID(carID, string(args.Search("reader")))
+	_, contractID, _, err := cdb.GetValues(grantID.Slice())
+	if err != nil || contractID != ContractReadGrantID {
+		return nil, errors.New("no read grant for this reader")
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Remove, grantID, ContractReadGrantID, nil, carDarcID),
+	}, nil
+}
+
+// ContractReadGrant can only be invoked with read by the reader of the
+// grant, to spawn the Calypso read instance of the write instance in the
+// "read" argument. The write instance must belong to the car of the grant,
+// the grant must not be expired and the car must still have the owner who
+// gave the grant.
+func ContractReadGrant(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	cIn []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+
+	cOut = cIn
+	if inst.GetType() != byzcoin.InvokeType || inst.Invoke.Command != "read" {
+		return nil, nil, errors.New("read grants can only be invoked to read")
+	}
+	grantBuf, _, grantDarcID, err := cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+	var grant ReadGrant
+	err = protobuf.Decode(grantBuf, &grant)
+	if err != nil {
+		return
+	}
+	err = verifyGrantSignature(cdb, inst, grantDarcID, grant.Reader)
+	if err != nil {
+		return
+	}
+	if !time.Now().Before(time.Unix(grant.Expiry, 0)) {
+		return nil, nil, errors.New("the read grant is expired")
+	}
+
+	carBuf, _, carDarcID, err := cdb.GetValues(grant.CarInstanceID)
+	if err != nil {
+		return
+	}
+	var car Car
+	err = protobuf.Decode(carBuf, &car)
+	if err != nil {
+		return
+	}
+	if car.Owner != grant.Owner {
+		return nil, nil, errors.New("the car changed owner since the read was granted")
+	}
+
+	readBuf := inst.Invoke.Args.Search("read")
+	var read calypso.Read
+	err = protobuf.DecodeWithConstructors(readBuf, &read, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, errors.New("not a calypso read")
+	}
+	_, contractID, writeDarcID, err := cdb.GetValues(read.Write.Slice())
+	if err != nil {
+		return
+	}
+	if contractID != calypso.ContractWriteID || !writeDarcID.Equal(carDarcID) {
+		return nil, nil, errors.New("the grant only allows to read the reports of its car")
+	}
+	scs = []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+			calypso.ContractReadID, readBuf, writeDarcID),
+	}
+	return
+}
+
+// verifyGrantSignature checks the signatures of the instruction, signed like
+// the instructions on the darc of the grant, and that the signers fulfil the
+// reader identity of the grant, which can be a darc.
+func verifyGrantSignature(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	darcID darc.ID, reader string) error {
+
+	signatures := inst.Signatures
+	identities := make([]darc.Identity, len(signatures))
+	signers := make([]string, len(signatures))
+	for i, sig := range signatures {
+		identities[i] = sig.Signer
+		signers[i] = sig.Signer.String()
+	}
+	digest, err := instructionDigest(&inst, darcID, identities)
+	if err != nil {
+		return err
+	}
+	for _, sig := range signatures {
+		if err = sig.Signer.Verify(digest, sig.Signature); err != nil {
+			return err
+		}
+	}
+	if darc.EvalExpr(expression.InitAndExpr(reader), darcGetter(cdb), signers...) != nil {
+		return errors.New("the read must be signed by the reader of the grant")
+	}
+	return nil
+}
+
+// GrantRead lets the reader read the reports of the car until the expiry,
+// as long as the car doesn't change owner. The signers must fulfil the
+// invoke:grantRead rule of the car darc.
+func (c *Client) GrantRead(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	reader darc.Identity, expiry time.Time, signers ...darc.Signer) error {
+
+	grantBuf, err := protobuf.Encode(&ReadGrant{
+		Reader: reader.String(),
+		Expiry: expiry.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.sendCarCommand(instID, controlDarc, "grantRead",
+		byzcoin.Arguments{{Name: "grant", Value: grantBuf}}, signers...)
+}
+
+// RevokeReadGrant removes the read grant of the reader before it expires.
+// The signers must fulfil the invoke:revokeRead rule of the car darc.
+func (c *Client) RevokeReadGrant(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	reader darc.Identity, signers ...darc.Signer) error {
+
+	return c.sendCarCommand(instID, controlDarc, "revokeRead",
+		byzcoin.Arguments{{Name: "reader", Value: []byte(reader.String())}}, signers...)
+}
+
+// GetReadGrant returns the read grant of the reader for the car.
+func (c *Client) GetReadGrant(instID byzcoin.InstanceID, reader darc.Identity) (*ReadGrant, error) {
+	var grant ReadGrant
+	err := c.getInstance(ReadGrantID(instID, reader.String()), ContractReadGrantID, &grant)
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// ReadReportsWithGrant returns the decrypted secrets of the effective
+// history of the car, read with the grant of the reader. The signers must
+// fulfil the reader identity of the grant, and the secrets are re-encrypted
+// to the signer of this identity, or to the first signer if the reader is a
+// darc.
+func (c *Client) ReadReportsWithGrant(instID byzcoin.InstanceID, reader darc.Identity,
+	signers ...darc.Signer) ([]SecretData, error) {
+
+	signerR, spawnReads, err := c.grantReads(instID, reader, signers)
+	if err != nil {
+		return nil, err
+	}
+	carData, err := c.GetCar(instID)
+	if err != nil {
+		return nil, err
+	}
+	trail, err := c.GetReportsPage(instID, 0, carData.ReportCount)
+	if err != nil {
+		return nil, err
+	}
+	return c.readSecrets(EffectiveReports(trail), signerR, spawnReads)
+}
+
+// grantReads returns the signer the secrets are re-encrypted to and the
+// function spawning the read instances with the grant of the reader
+func (c *Client) grantReads(instID byzcoin.InstanceID, reader darc.Identity,
+	signers []darc.Signer) (darc.Signer, func(writeIDs [][]byte) ([]byzcoin.InstanceID, error), error) {
+
+	var signerR *darc.Signer
+	for i := range signers {
+		if signers[i].Identity().String() == reader.String() {
+			signerR = &signers[i]
+		}
+	}
+	if signerR == nil && reader.Darc != nil && len(signers) > 0 {
+		//the first signer reads for the darc of the grant
+		signerR = &signers[0]
+	}
+	if signerR == nil {
+		return darc.Signer{}, nil, errors.New("the reader of the grant must sign the reads")
+	}
+	grantID := ReadGrantID(instID, reader.String())
+	resp, err := c.ByzCoin.GetProof(grantID.Slice())
+	if err != nil {
+		return darc.Signer{}, nil, err
+	}
+	if !resp.Proof.InclusionProof.Match(grantID.Slice()) {
+		return darc.Signer{}, nil, errors.New("no read grant for this reader")
+	}
+	_, _, _, carDarcID, err := resp.Proof.KeyValue()
+	if err != nil {
+		return darc.Signer{}, nil, err
+	}
+	xc, err := readerPoint(*signerR)
+	if err != nil {
+		return darc.Signer{}, nil, err
+	}
+	return *signerR, func(writeIDs [][]byte) ([]byzcoin.InstanceID, error) {
+		args := make([]byzcoin.Arguments, len(writeIDs))
+		for i, writeID := range writeIDs {
+			readBuf, err := protobuf.Encode(&calypso.Read{
+				Write: byzcoin.NewInstanceID(writeID),
+				Xc:    xc,
+			})
+			if err != nil {
+				return nil, err
+			}
+			args[i] = byzcoin.Arguments{{Name: "read", Value: readBuf}}
+		}
+		return c.invokeReads(grantID, carDarcID, "read", args, signers)
+	}, nil
+}
+
+// sendCarCommand sends the instruction invoking the command with the
+// arguments on the car instance
+func (c *Client) sendCarCommand(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	command string, args byzcoin.Arguments, signers ...darc.Signer) error {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: instID,
+			Nonce:      byzcoin.Nonce{},
+			Index:      0,
+			Length:     1,
+			Invoke: &byzcoin.Invoke{
+				Command: command,
+				Args:    args,
+			},
+		}},
+	}
+	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
@@ -0,0 +1,16 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadGrantID(t *testing.T) {
+	car1 := byzcoin.NewInstanceID([]byte("car 1"))
+	car2 := byzcoin.NewInstanceID([]byte("car 2"))
+	require.Equal(t, ReadGrantID(car1, "ed25519:1234"), ReadGrantID(car1, "ed25519:1234"))
+	require.NotEqual(t, ReadGrantID(car1, "ed25519:1234"), ReadGrantID(car2, "ed25519:1234"))
+	require.NotEqual(t, ReadGrantID(car1, "ed25519:1234"), ReadGrantID(car1, "ed25519:5678"))
+}
@@ -0,0 +1,261 @@
+package car
+
+/*
+The history.go stores every report in its own instance, so that the cost of
+adding a report doesn't grow with the history of the car. The car only keeps
+the number of reports and what is needed to check the next one: the report
+with index i is stored at ReportInstanceID(car, i). Every report still
+updates the car instance, as its index is the number of reports and its
+mileage is proven against the mileage commitment of the car, so the reports
+of a car are added one after the other: a report whose range proof was made
+before another report of the car is refused and has to be made again.
+Amending or retracting an original report also updates its ReportState, so
+that the effective history of a page of reports can be read without reading
+the whole audit trail.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+)
+
+// errInstanceNotFound is returned by getInstance if the instance doesn't
+// exist
+var errInstanceNotFound = errors.New("instance not found")
+
+// ContractReportID is the contract ID of the report instances, they are
+// only created by the car contract.
+var ContractReportID = "carReport"
+
+// ContractReportStateID is the contract ID of the states of the amended and
+// retracted reports, they are only created by the car contract.
+var ContractReportStateID = "carReportState"
+
+// MaxReportsPage is the biggest number of reports returned at once by the
+// service.
+const MaxReportsPage = 100
+
+// ReportInstanceID returns the ID of the instance holding the report with
+// the given index of the car.
+func ReportInstanceID(carID byzcoin.InstanceID, index uint32) byzcoin.InstanceID {
+	return indexedInstanceID(ContractReportID, carID, index)
+}
+
+// ReportStateID returns the ID of the instance holding the state of the
+// report with the given index of the car.
+func ReportStateID(carID byzcoin.InstanceID, index uint32) byzcoin.InstanceID {
+	return indexedInstanceID(ContractReportStateID, carID, index)
+}
+
+func indexedInstanceID(prefix string, carID byzcoin.InstanceID, index uint32) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(prefix))
+	h.Write(carID.Slice())
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], index)
+	h.Write(buf[:])
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// EffectiveReports returns the reports of the audit trail, where every
+// original report is replaced by its last amendment and the retracted
+// reports are left out. The trail must start with the first report of the
+// car.
+func EffectiveReports(trail []Report) []Report {
+	var reports []Report
+	for _, i := range effectiveIndexes(trail) {
+		reports = append(reports, trail[i])
+	}
+	return reports
+}
+
+// effectiveIndexes returns the indexes in the trail of the reports of
+// EffectiveReports
+func effectiveIndexes(trail []Report) []uint32 {
+	var effective []uint32
+	var retracted []bool
+	position := map[uint32]int{}
+	for i, r := range trail {
+		if r.Amends == nil {
+			position[uint32(i)] = len(effective)
+			effective = append(effective, uint32(i))
+			retracted = append(retracted, false)
+			continue
+		}
+		p, ok := position[r.Amends.Index]
+		if !ok {
+			continue
+		}
+		if r.Retraction {
+			retracted[p] = true
+		} else {
+			effective[p] = uint32(i)
+		}
+	}
+	var indexes []uint32
+	for i, index := range effective {
+		if !retracted[i] {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// newReportStateChange returns the state change creating the report with
+// the next index of the car.
+func (car *Car) newReportStateChange(carID byzcoin.InstanceID, r Report,
+	darcID darc.ID) (byzcoin.StateChange, error) {
+
+	buf, err := protobuf.Encode(&r)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	sc := byzcoin.NewStateChange(byzcoin.Create, ReportInstanceID(carID, car.ReportCount),
+		ContractReportID, buf, darcID)
+	car.ReportCount++
+	car.LastTimestamp = r.Timestamp
+	return sc, nil
+}
+
+// loadReport returns the report with the given index from the global state
+func loadReport(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID, index uint32) (*Report, error) {
+	buf, contractID, _, err := cdb.GetValues(ReportInstanceID(carID, index).Slice())
+	if err != nil {
+		return nil, err
+	}
+	if contractID != ContractReportID {
+		return nil, errors.New("not a report instance")
+	}
+	var r Report
+	err = protobuf.Decode(buf, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// loadReportState returns the state of the report with the given index, and
+// whether it exists in the global state
+func loadReportState(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID,
+	index uint32) (*ReportState, bool, error) {
+
+	buf, _, _, err := cdb.GetValues(ReportStateID(carID, index).Slice())
+	if err != nil {
+		return &ReportState{}, false, nil
+	}
+	var state ReportState
+	err = protobuf.Decode(buf, &state)
+	if err != nil {
+		return nil, false, err
+	}
+	return &state, true, nil
+}
+
+// instanceGetter decodes the value of an instance of the given contract
+type instanceGetter func(id byzcoin.InstanceID, contractID string, value interface{}) error
+
+// reportsPage returns the reports of the car from index from to from+count-1
+func reportsPage(carID byzcoin.InstanceID, reportCount, from, count uint32,
+	get instanceGetter) ([]Report, error) {
+
+	var reports []Report
+	for i := from; i < reportCount && i-from < count; i++ {
+		var r Report
+		err := get(ReportInstanceID(carID, i), ContractReportID, &r)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// effectivePage returns the effective history of the original reports of
+// the page of the audit trail starting at index from
+func effectivePage(carID byzcoin.InstanceID, from uint32, trail []Report,
+	get instanceGetter) ([]Report, error) {
+
+	var effective []Report
+	for i, r := range trail {
+		if r.Amends != nil {
+			continue
+		}
+		var state ReportState
+		err := get(ReportStateID(carID, from+uint32(i)), ContractReportStateID, &state)
+		if err != nil && err != errInstanceNotFound {
+			return nil, err
+		}
+		if state.Retracted {
+			continue
+		}
+		if state.Amended {
+			err = get(ReportInstanceID(carID, state.Amendment), ContractReportID, &r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		effective = append(effective, r)
+	}
+	return effective, nil
+}
+
+// GetReport returns the report with the given index of the car.
+func (c *Client) GetReport(carID byzcoin.InstanceID, index uint32) (*Report, error) {
+	var r Report
+	err := c.getInstance(ReportInstanceID(carID, index), ContractReportID, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetReportsPage returns the page of the audit trail of the car, with the
+// reports from index from to from+count-1.
+func (c *Client) GetReportsPage(carID byzcoin.InstanceID, from, count uint32) ([]Report, error) {
+	carData, err := c.GetCar(carID)
+	if err != nil {
+		return nil, err
+	}
+	return reportsPage(carID, carData.ReportCount, from, count, c.getInstance)
+}
+
+// GetEffectiveReports returns the effective history of the original reports
+// with an index from from to from+count-1.
+func (c *Client) GetEffectiveReports(carID byzcoin.InstanceID, from, count uint32) ([]Report, error) {
+	trail, err := c.GetReportsPage(carID, from, count)
+	if err != nil {
+		return nil, err
+	}
+	return effectivePage(carID, from, trail, c.getInstance)
+}
+
+// getInstance decodes the value of the instance, which must be of the given
+// contract
+func (c *Client) getInstance(id byzcoin.InstanceID, contractID string, value interface{}) error {
+	resp, err := c.ByzCoin.GetProof(id.Slice())
+	if err != nil {
+		return err
+	}
+	return decodeInstance(&resp.Proof, id, contractID, value)
+}
+
+// decodeInstance decodes the value of the instance in the proof, which must
+// be of the given contract
+func decodeInstance(pr *byzcoin.Proof, id byzcoin.InstanceID, contractID string, value interface{}) error {
+	if !pr.InclusionProof.Match(id.Slice()) {
+		return errInstanceNotFound
+	}
+	_, buf, cID, _, err := pr.KeyValue()
+	if err != nil {
+		return err
+	}
+	if cID != contractID {
+		return errors.New("wrong contract of the instance")
+	}
+	return protobuf.Decode(buf, value)
+}
@@ -0,0 +1,34 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectiveReports(t *testing.T) {
+	trail := []Report{{Note: "first"}, {Note: "second"}, {Note: "third"}}
+	hash0, err := trail[0].Hash()
+	require.Nil(t, err)
+	hash1, err := trail[1].Hash()
+	require.Nil(t, err)
+	trail = append(trail,
+		Report{Note: "first amended", Amends: &ReportRef{Index: 0, Hash: hash0}},
+		Report{Retraction: true, Amends: &ReportRef{Index: 1, Hash: hash1}})
+
+	effective := EffectiveReports(trail)
+	require.Equal(t, 2, len(effective))
+	require.Equal(t, "first amended", effective[0].Note)
+	require.Equal(t, "third", effective[1].Note)
+	require.Equal(t, []uint32{3, 2}, effectiveIndexes(trail))
+}
+
+func TestReportInstanceID(t *testing.T) {
+	car1 := byzcoin.NewInstanceID([]byte("car1"))
+	car2 := byzcoin.NewInstanceID([]byte("car2"))
+	require.Equal(t, ReportInstanceID(car1, 1), ReportInstanceID(car1, 1))
+	require.NotEqual(t, ReportInstanceID(car1, 1), ReportInstanceID(car1, 2))
+	require.NotEqual(t, ReportInstanceID(car1, 1), ReportInstanceID(car2, 1))
+	require.NotEqual(t, ReportInstanceID(car1, 1), ReportStateID(car1, 1))
+}
@@ -0,0 +1,216 @@
+package car
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber"
+	"github.com/dedis/protobuf"
+)
+
+// The instructions are built the same way by the Client and by the Service,
+// so that a thin client only needs to sign the digest returned by the
+// service.
+
+// newCarInstruction returns the spawn:car instruction for the car darc
+func newCarInstruction(car Car, darcID darc.ID) (byzcoin.Instruction, error) {
+	carBuf, err := protobuf.Encode(&car)
+	if err != nil {
+		return byzcoin.Instruction{}, err
+	}
+	return byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(darcID),
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractCarID,
+			Args:       byzcoin.Arguments{{Name: "car", Value: carBuf}},
+		},
+	}, nil
+}
+
+// newReportInstruction returns the invoke:addReport instruction adding the
+// report to the car instance
+func newReportInstruction(instID byzcoin.InstanceID, report Report) (byzcoin.Instruction, error) {
+	return newReportCommand(instID, "addReport", report)
+}
+
+// newReportCommand returns the instruction invoking the command of the car
+// contract with the report as argument
+func newReportCommand(instID byzcoin.InstanceID, command string, report Report) (byzcoin.Instruction, error) {
+	reportBuf, err := protobuf.Encode(&report)
+	if err != nil {
+		return byzcoin.Instruction{}, err
+	}
+	return byzcoin.Instruction{
+		InstanceID: instID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    byzcoin.Arguments{{Name: "report", Value: reportBuf}},
+		},
+	}, nil
+}
+
+// newWriteInstruction returns the spawn:calypsoWrite instruction storing the
+// encoded calypso.Write under the car darc
+func newWriteInstruction(darcID darc.ID, writeBuf []byte) byzcoin.Instruction {
+	return byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(darcID),
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Spawn: &byzcoin.Spawn{
+			ContractID: calypso.ContractWriteID,
+			Args:       byzcoin.Arguments{{Name: "write", Value: writeBuf}},
+		},
+	}
+}
+
+// newReadInstruction returns the spawn:calypsoRead instruction asking for the
+// secret of the write instance to be re-encrypted to xc
+func newReadInstruction(writeID byzcoin.InstanceID, xc kyber.Point) (byzcoin.Instruction, error) {
+	readBuf, err := protobuf.Encode(&calypso.Read{
+		Write: writeID,
+		Xc:    xc,
+	})
+	if err != nil {
+		return byzcoin.Instruction{}, err
+	}
+	return byzcoin.Instruction{
+		InstanceID: writeID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Spawn: &byzcoin.Spawn{
+			ContractID: calypso.ContractReadID,
+			Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
+		},
+	}, nil
+}
+
+// newSecretWrite encrypts wData with the symmetric key and returns the
+// encoded calypso.Write holding it, with the key encrypted to the LTS
+func newSecretWrite(key []byte, wData SecretData, darcID darc.ID,
+	lts *calypso.CreateLTSReply) ([]byte, error) {
+
+	writeDataBuf, err := EncodeSecretData(&wData)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedWrite(key, writeDataBuf, darcID, lts)
+}
+
+// newEncryptedWrite encrypts the data with the symmetric key and returns the
+// encoded calypso.Write holding it, with the key encrypted to the LTS
+func newEncryptedWrite(key []byte, data []byte, darcID darc.ID,
+	lts *calypso.CreateLTSReply) ([]byte, error) {
+
+	if lts == nil {
+		return nil, errors.New("no LTS given")
+	}
+	write := calypso.NewWrite(cothority.Suite, lts.LTSID, darcID, lts.X, key)
+	var err error
+	write.Data, err = encrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(write)
+}
+
+// instructionDigest sets the identities of the signers in the instruction
+// and returns the digest they have to sign
+func instructionDigest(instr *byzcoin.Instruction, darcID darc.ID,
+	signers []darc.Identity) ([]byte, error) {
+
+	instr.Signatures = make([]darc.Signature, len(signers))
+	for i := range signers {
+		instr.Signatures[i].Signer = signers[i]
+	}
+	req, err := instr.ToDarcRequest(darcID)
+	if err != nil {
+		return nil, err
+	}
+	req.Identities = signers
+	return req.Hash(), nil
+}
+
+// addSignatures adds the signatures of the digest returned by
+// instructionDigest to the instruction
+func addSignatures(instr *byzcoin.Instruction, darcID darc.ID,
+	signers []darc.Identity, signatures [][]byte) error {
+
+	if len(signers) != len(signatures) {
+		return errors.New("need one signature per signer")
+	}
+	digest, err := instructionDigest(instr, darcID, signers)
+	if err != nil {
+		return err
+	}
+	for i := range signatures {
+		if err = signers[i].Verify(digest, signatures[i]); err != nil {
+			return err
+		}
+		instr.Signatures[i].Signature = signatures[i]
+	}
+	return nil
+}
+
+// newTransferInstruction returns the invoke:transferOwnership instruction
+// giving the car instance to the owner darc
+func newTransferInstruction(instID byzcoin.InstanceID, owner, reader, garage darc.ID) byzcoin.Instruction {
+	return byzcoin.Instruction{
+		InstanceID: instID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Invoke: &byzcoin.Invoke{
+			Command: "transferOwnership",
+			Args: byzcoin.Arguments{
+				{Name: "owner", Value: owner},
+				{Name: "reader", Value: reader},
+				{Name: "garage", Value: garage},
+			},
+		},
+	}
+}
+
+// newStatusInstruction returns the invoke:setStatus instruction changing
+// the status of the car instance
+func newStatusInstruction(instID byzcoin.InstanceID, status string) byzcoin.Instruction {
+	return byzcoin.Instruction{
+		InstanceID: instID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Invoke: &byzcoin.Invoke{
+			Command: "setStatus",
+			Args:    byzcoin.Arguments{{Name: "status", Value: []byte(status)}},
+		},
+	}
+}
+
+// newMetadataInstruction returns the invoke:updateMetadata instruction
+// replacing the metadata of the car instance
+func newMetadataInstruction(instID byzcoin.InstanceID, metadata CarMetadata) (byzcoin.Instruction, error) {
+	metadataBuf, err := protobuf.Encode(&metadata)
+	if err != nil {
+		return byzcoin.Instruction{}, err
+	}
+	return byzcoin.Instruction{
+		InstanceID: instID,
+		Nonce:      byzcoin.Nonce{},
+		Index:      0,
+		Length:     1,
+		Invoke: &byzcoin.Invoke{
+			Command: "updateMetadata",
+			Args:    byzcoin.Arguments{{Name: "metadata", Value: metadataBuf}},
+		},
+	}, nil
+}
@@ -0,0 +1,103 @@
+package car
+
+/*
+The lifecycle.go keeps track of what happened to the car itself: a car is
+active until it is stolen, exported or scrapped. The status is stored in the
+public Car, so anybody can check it without reading the reports. A scrapped
+car stays in the ledger with its history, but no more reports can be added,
+and its VIN stays in the registry so that it can't be spawned again.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+)
+
+// The lifecycle states of a car.
+const (
+	StatusActive   = "active"
+	StatusStolen   = "stolen"
+	StatusExported = "exported"
+	StatusScrapped = "scrapped"
+)
+
+// statusTransitions lists the states a car can go to from each state. A
+// stolen car can be found again and an exported car imported again, but a
+// scrapped car can't leave this state.
+var statusTransitions = map[string][]string{
+	StatusActive:   {StatusStolen, StatusExported, StatusScrapped},
+	StatusStolen:   {StatusActive, StatusScrapped},
+	StatusExported: {StatusActive, StatusScrapped},
+	StatusScrapped: nil,
+}
+
+// ValidateStatus returns an error if status is not one of the Status* states.
+func ValidateStatus(status string) error {
+	if _, ok := statusTransitions[status]; !ok {
+		return fmt.Errorf("unknown status of a car %q", status)
+	}
+	return nil
+}
+
+// SetStatus changes the status of the car to the one given in the "status"
+// argument, if the transition is allowed.
+func (car *Car) SetStatus(args byzcoin.Arguments) error {
+	status := string(args.Search("status"))
+	err := ValidateStatus(status)
+	if err != nil {
+		return err
+	}
+	for _, next := range statusTransitions[car.Status] {
+		if next == status {
+			car.Status = status
+			return nil
+		}
+	}
+	return fmt.Errorf("a car can't go from %s to %s", car.Status, status)
+}
+
+// verifyStatus checks that the command can be invoked on the car in its
+// current status: a scrapped car only accepts corrections and reads of its
+// history and a stolen car can't be transferred.
+func (car *Car) verifyStatus(command string) error {
+	_, read := fieldOfCommand(command)
+	switch car.Status {
+	case StatusScrapped:
+		if !read && command != "amendReport" && command != "retractReport" && command != "setStatus" {
+			return errors.New("the car is scrapped")
+		}
+	case StatusStolen:
+		if command == "transferOwnership" {
+			return errors.New("a stolen car can't be transferred")
+		}
+	}
+	return nil
+}
+
+// SetStatus changes the status of the car. The signers must fulfil the
+// invoke:setStatus rule of the car darc.
+func (c *Client) SetStatus(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	status string, signers ...darc.Signer) error {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{newStatusInstruction(instID, status)},
+	}
+	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
+
+// GetStatus returns the status of the car, which is public.
+func (c *Client) GetStatus(instID byzcoin.InstanceID) (string, error) {
+	car, err := c.GetCar(instID)
+	if err != nil {
+		return "", err
+	}
+	return car.Status, nil
+}
@@ -0,0 +1,34 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCar_SetStatus(t *testing.T) {
+	status := func(s string) byzcoin.Arguments {
+		return byzcoin.Arguments{{Name: "status", Value: []byte(s)}}
+	}
+	car := NewCar("1M8GDM9AXKP042788")
+	require.Equal(t, StatusActive, car.Status)
+	require.NotNil(t, car.SetStatus(status("sold")))
+	require.NotNil(t, car.SetStatus(status(StatusActive)))
+
+	require.Nil(t, car.SetStatus(status(StatusStolen)))
+	require.NotNil(t, car.verifyStatus("transferOwnership"))
+	require.Nil(t, car.verifyStatus("addReport"))
+	require.NotNil(t, car.SetStatus(status(StatusExported)))
+	require.Nil(t, car.SetStatus(status(StatusActive)))
+
+	require.Nil(t, car.SetStatus(status(StatusExported)))
+	require.Nil(t, car.SetStatus(status(StatusScrapped)))
+	require.NotNil(t, car.verifyStatus("addReport"))
+	require.NotNil(t, car.verifyStatus("transferOwnership"))
+	require.Nil(t, car.verifyStatus("retractReport"))
+	//a scrapped car stays scrapped
+	for s := range statusTransitions {
+		require.NotNil(t, car.SetStatus(status(s)))
+	}
+}
@@ -0,0 +1,92 @@
+package car
+
+/*
+The metadata.go lets the admin of a car, usually the manufacturer, describe
+the car publicly: buyers and insurers can see the make, the model or the
+fuel type of the car before asking to read its reports. The metadata is in
+the Car, so it is not encrypted, and it can only be changed with the
+invoke:updateMetadata rule of the car darc.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+)
+
+// The fuel types of a car.
+const (
+	FuelPetrol   = "petrol"
+	FuelDiesel   = "diesel"
+	FuelElectric = "electric"
+	FuelHybrid   = "hybrid"
+	FuelLPG      = "lpg"
+	FuelCNG      = "cng"
+	FuelHydrogen = "hydrogen"
+)
+
+// firstModelYear is the year the first car was built
+const firstModelYear = 1886
+
+// maxMetadataLength is the longest text a field of the metadata can hold
+const maxMetadataLength = 64
+
+// Validate checks the fields of the metadata which are set.
+func (m *CarMetadata) Validate() error {
+	switch m.FuelType {
+	case "", FuelPetrol, FuelDiesel, FuelElectric, FuelHybrid, FuelLPG, FuelCNG, FuelHydrogen:
+	default:
+		return fmt.Errorf("unknown fuel type %q", m.FuelType)
+	}
+	if m.ModelYear != 0 && m.ModelYear < firstModelYear {
+		return errors.New("the model year is too early")
+	}
+	if m.FirstRegistration < 0 {
+		return errors.New("the first registration can't be before 1970")
+	}
+	for _, field := range []string{m.Make, m.Model, m.Colour} {
+		if len(field) > maxMetadataLength {
+			return errors.New("a field of the metadata is too long")
+		}
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the metadata of the car by the one given in the
+// "metadata" argument.
+func (car *Car) UpdateMetadata(args byzcoin.Arguments) error {
+	var m CarMetadata
+	err := protobuf.Decode(args.Search("metadata"), &m)
+	if err != nil {
+		return errors.New("not a car metadata")
+	}
+	err = m.Validate()
+	if err != nil {
+		return err
+	}
+	car.Metadata = m
+	return nil
+}
+
+// UpdateMetadata replaces the public metadata of the car. The signers must
+// fulfil the invoke:updateMetadata rule of the car darc.
+func (c *Client) UpdateMetadata(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	metadata CarMetadata, signers ...darc.Signer) error {
+
+	instr, err := newMetadataInstruction(instID, metadata)
+	if err != nil {
+		return err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{instr},
+	}
+	err = ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	return err
+}
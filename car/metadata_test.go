@@ -0,0 +1,35 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCar_UpdateMetadata(t *testing.T) {
+	update := func(car *Car, m CarMetadata) error {
+		buf, err := protobuf.Encode(&m)
+		require.Nil(t, err)
+		return car.UpdateMetadata(byzcoin.Arguments{{Name: "metadata", Value: buf}})
+	}
+	car := NewCar("1M8GDM9AXKP042788")
+	require.NotNil(t, update(&car, CarMetadata{FuelType: "coal"}))
+	require.NotNil(t, update(&car, CarMetadata{ModelYear: 1700}))
+	require.NotNil(t, update(&car, CarMetadata{FirstRegistration: -1}))
+
+	m := CarMetadata{
+		Make:              "Honda",
+		Model:             "Accord",
+		ModelYear:         2003,
+		FuelType:          FuelPetrol,
+		FirstRegistration: 1041379200,
+		Colour:            "silver",
+	}
+	require.Nil(t, update(&car, m))
+	require.Equal(t, m, car.Metadata)
+	//the metadata is replaced, not merged
+	require.Nil(t, update(&car, CarMetadata{Colour: "red"}))
+	require.Equal(t, "", car.Metadata.Make)
+}
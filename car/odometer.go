@@ -0,0 +1,214 @@
+package car
+
+/*
+The odometer.go makes the mileage of the reports tamper-evident. Every report
+holds a Pedersen commitment to the mileage
+
+	C = mileage*G + blinding*H
+
+and a range proof showing that the difference to the commitment of the
+previous report is a number between 0 and 2^mileageBits-1. The mileage is
+always committed in kilometers. The mileage and the blinding factor stay in
+the encrypted SecretData, so only the readers of the reports can open the
+commitments.
+
+The range proof commits to every bit of the difference and proves with an
+OR-proof that each commitment holds either 0 or 1. The sum of the bit
+commitments, weighted by powers of two, must be equal to the difference of
+the two mileage commitments.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// mileageBits is the number of bits of the difference between the mileage
+// of two reports that can be proven.
+const mileageBits = 32
+
+// mileageH is the second generator of the Pedersen commitments, nobody knows
+// its discrete logarithm with regard to the base point.
+var mileageH = cothority.Suite.Point().Pick(cothority.Suite.XOF([]byte("car.mileage.H")))
+
+// MileageCommitment returns the Pedersen commitment to the mileage.
+func MileageCommitment(mileage uint64, blinding kyber.Scalar) kyber.Point {
+	m := cothority.Suite.Point().Mul(scalarUint64(mileage), nil)
+	return m.Add(m, cothority.Suite.Point().Mul(blinding, mileageH))
+}
+
+// NewMileageProof returns a proof that the mileage committed with the
+// blinding is not lower than the previous mileage committed with prevBlinding.
+func NewMileageProof(prevMileage uint64, prevBlinding kyber.Scalar,
+	mileage uint64, blinding kyber.Scalar) (*MileageProof, error) {
+
+	if mileage < prevMileage {
+		return nil, errors.New("the mileage is lower than the previous one")
+	}
+	diff := mileage - prevMileage
+	if diff>>mileageBits != 0 {
+		return nil, errors.New("the mileage difference is too big")
+	}
+	prev := MileageCommitment(prevMileage, prevBlinding)
+	commitment := MileageCommitment(mileage, blinding)
+
+	//the blinding factors of the bits must add up to the blinding of the difference
+	suite := cothority.Suite
+	rDiff := suite.Scalar().Sub(blinding, prevBlinding)
+	rSum := suite.Scalar().Zero()
+	rBits := make([]kyber.Scalar, mileageBits)
+	for i := 0; i < mileageBits-1; i++ {
+		rBits[i] = suite.Scalar().Pick(suite.RandomStream())
+		rSum.Add(rSum, suite.Scalar().Mul(rBits[i], powerOfTwo(i)))
+	}
+	rLast := suite.Scalar().Sub(rDiff, rSum)
+	rBits[mileageBits-1] = rLast.Div(rLast, powerOfTwo(mileageBits-1))
+
+	proof := &MileageProof{}
+	for i := 0; i < mileageBits; i++ {
+		bit := (diff >> uint(i)) & 1
+		c := suite.Point().Mul(rBits[i], mileageH)
+		if bit == 1 {
+			c.Add(c, suite.Point().Base())
+		}
+		//ys[b] = rBits[i]*H if the bit is b
+		ys := [2]kyber.Point{c, suite.Point().Sub(c, suite.Point().Base())}
+		own, sim := bit, 1-bit
+
+		var cs, ss [2]kyber.Scalar
+		var as [2]kyber.Point
+		cs[sim] = suite.Scalar().Pick(suite.RandomStream())
+		ss[sim] = suite.Scalar().Pick(suite.RandomStream())
+		as[sim] = suite.Point().Sub(suite.Point().Mul(ss[sim], mileageH),
+			suite.Point().Mul(cs[sim], ys[sim]))
+		k := suite.Scalar().Pick(suite.RandomStream())
+		as[own] = suite.Point().Mul(k, mileageH)
+
+		challenge := bitChallenge(prev, commitment, i, c, as[0], as[1])
+		cs[own] = suite.Scalar().Sub(challenge, cs[sim])
+		ss[own] = suite.Scalar().Add(k, suite.Scalar().Mul(cs[own], rBits[i]))
+
+		proof.Bits = append(proof.Bits, c)
+		proof.C0 = append(proof.C0, cs[0])
+		proof.C1 = append(proof.C1, cs[1])
+		proof.S0 = append(proof.S0, ss[0])
+		proof.S1 = append(proof.S1, ss[1])
+	}
+	return proof, nil
+}
+
+// Verify checks that the mileage in commitment is not lower than the
+// mileage in prev.
+func (p *MileageProof) Verify(prev, commitment kyber.Point) error {
+	if len(p.Bits) != mileageBits || len(p.C0) != mileageBits || len(p.C1) != mileageBits ||
+		len(p.S0) != mileageBits || len(p.S1) != mileageBits {
+		return errors.New("wrong size of the mileage proof")
+	}
+	suite := cothority.Suite
+	sum := suite.Point().Null()
+	for i := 0; i < mileageBits; i++ {
+		c := p.Bits[i]
+		y0 := c
+		y1 := suite.Point().Sub(c, suite.Point().Base())
+		a0 := suite.Point().Sub(suite.Point().Mul(p.S0[i], mileageH), suite.Point().Mul(p.C0[i], y0))
+		a1 := suite.Point().Sub(suite.Point().Mul(p.S1[i], mileageH), suite.Point().Mul(p.C1[i], y1))
+		challenge := bitChallenge(prev, commitment, i, c, a0, a1)
+		if !challenge.Equal(suite.Scalar().Add(p.C0[i], p.C1[i])) {
+			return errors.New("wrong proof for a bit of the mileage difference")
+		}
+		sum.Add(sum, suite.Point().Mul(powerOfTwo(i), c))
+	}
+	if !sum.Equal(suite.Point().Sub(commitment, prev)) {
+		return errors.New("the bits don't add up to the mileage difference")
+	}
+	return nil
+}
+
+// CommitMileage adds the commitment to the mileage of secret and the proof
+// that it's not lower than the mileage of the previous report to the report.
+// The blinding factor is stored in secret, so that the readers can open the
+// commitment. previous is nil for the first report of a car.
+func (r *Report) CommitMileage(secret *SecretData, previous *SecretData) error {
+	err := secret.Validate()
+	if err != nil {
+		return err
+	}
+	mileage := secret.MileageKm()
+	var prevMileage uint64
+	prevBlinding := cothority.Suite.Scalar().Zero()
+	if previous != nil {
+		prevMileage = previous.MileageKm()
+		err = prevBlinding.UnmarshalBinary(previous.MileageBlinding)
+		if err != nil {
+			return errors.New("no blinding factor in the previous report")
+		}
+	}
+	blinding := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	proof, err := NewMileageProof(prevMileage, prevBlinding, mileage, blinding)
+	if err != nil {
+		return err
+	}
+	r.MileageProof, err = protobuf.Encode(proof)
+	if err != nil {
+		return err
+	}
+	r.MileageCommitment, err = MileageCommitment(mileage, blinding).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	secret.MileageBlinding, err = blinding.MarshalBinary()
+	return err
+}
+
+// verifyMileage checks the mileage proof of the report against the
+// commitment of the last report of the effective history of the car.
+func (car *Car) verifyMileage(r Report) error {
+	prev := cothority.Suite.Point().Null()
+	if len(car.MileageCommitment) > 0 {
+		err := prev.UnmarshalBinary(car.MileageCommitment)
+		if err != nil {
+			return err
+		}
+	}
+	commitment := cothority.Suite.Point()
+	err := commitment.UnmarshalBinary(r.MileageCommitment)
+	if err != nil {
+		return errors.New("need a commitment to the mileage")
+	}
+	var proof MileageProof
+	err = protobuf.DecodeWithConstructors(r.MileageProof, &proof, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return errors.New("need a proof of the mileage")
+	}
+	return proof.Verify(prev, commitment)
+}
+
+// bitChallenge returns the Fiat-Shamir challenge of the OR-proof of a bit
+func bitChallenge(prev, commitment kyber.Point, i int, points ...kyber.Point) kyber.Scalar {
+	h := sha256.New()
+	prev.MarshalTo(h)
+	commitment.MarshalTo(h)
+	var index [4]byte
+	binary.LittleEndian.PutUint32(index[:], uint32(i))
+	h.Write(index[:])
+	for _, p := range points {
+		p.MarshalTo(h)
+	}
+	return cothority.Suite.Scalar().Pick(cothority.Suite.XOF(h.Sum(nil)))
+}
+
+func powerOfTwo(i int) kyber.Scalar {
+	return scalarUint64(uint64(1) << uint(i))
+}
+
+func scalarUint64(v uint64) kyber.Scalar {
+	high := cothority.Suite.Scalar().SetInt64(int64(v >> 32))
+	high.Mul(high, cothority.Suite.Scalar().SetInt64(1<<32))
+	return high.Add(high, cothority.Suite.Scalar().SetInt64(int64(v&0xffffffff)))
+}
@@ -0,0 +1,62 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMileageProof(t *testing.T) {
+	suite := cothority.Suite
+	r1 := suite.Scalar().Pick(suite.RandomStream())
+	r2 := suite.Scalar().Pick(suite.RandomStream())
+	prev := MileageCommitment(100000, r1)
+	commitment := MileageCommitment(120000, r2)
+
+	proof, err := NewMileageProof(100000, r1, 120000, r2)
+	require.Nil(t, err)
+	require.Nil(t, proof.Verify(prev, commitment))
+	//the same mileage is allowed
+	proof2, err := NewMileageProof(100000, r1, 100000, r2)
+	require.Nil(t, err)
+	require.Nil(t, proof2.Verify(prev, MileageCommitment(100000, r2)))
+
+	//a lower mileage can't be proven
+	_, err = NewMileageProof(120000, r1, 100000, r2)
+	require.NotNil(t, err)
+	//the proof doesn't hold for other commitments
+	require.NotNil(t, proof.Verify(prev, MileageCommitment(130000, r2)))
+	require.NotNil(t, proof.Verify(commitment, prev))
+	proof.S0[3] = suite.Scalar().Pick(suite.RandomStream())
+	require.NotNil(t, proof.Verify(prev, commitment))
+}
+
+func TestCar_verifyMileage(t *testing.T) {
+	var car Car
+	s1 := NewSecretData(ReportService, 100000, Kilometers)
+	var r1 Report
+	require.Nil(t, r1.CommitMileage(&s1, nil))
+	require.NotNil(t, s1.MileageBlinding)
+	require.Nil(t, car.verifyMileage(r1))
+	car.MileageCommitment = r1.MileageCommitment
+
+	//the blinding factor has to survive the encryption of the secret
+	buf, err := EncodeSecretData(&s1)
+	require.Nil(t, err)
+	previous, err := DecodeSecretData(buf)
+	require.Nil(t, err)
+
+	s2 := NewSecretData(ReportService, 75000, Miles)
+	var r2 Report
+	require.Nil(t, r2.CommitMileage(&s2, previous))
+	require.Nil(t, car.verifyMileage(r2))
+
+	//a report without a commitment or going back in mileage is refused
+	require.NotNil(t, car.verifyMileage(Report{}))
+	s3 := NewSecretData(ReportService, 90000, Kilometers)
+	var r3 Report
+	require.NotNil(t, r3.CommitMileage(&s3, previous))
+	require.Nil(t, r3.CommitMileage(&s3, nil))
+	require.NotNil(t, car.verifyMileage(r3))
+}
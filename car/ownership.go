@@ -0,0 +1,151 @@
+package car
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+)
+
+// TransferOwnership makes the darc given in the "owner" argument the new
+// owner of the car and keeps the former owner in the PreviousOwners. The car
+// darc is evolved so that only the darcs given in the "reader" and "garage"
+// arguments can read and add reports, and only the new owner can transfer the
+// car again, grant reads and, with the admin, change its status. If the
+// reader or the garage darc is missing, the owner darc is used instead. The
+// returned state change updates the car darc, so that it is done in the same
+// transaction as the update of the car.
+func (car *Car) TransferOwnership(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID,
+	args byzcoin.Arguments) ([]byzcoin.StateChange, error) {
+
+	owner := args.Search("owner")
+	if len(owner) == 0 {
+		return nil, errors.New("need an owner argument")
+	}
+	reader := args.Search("reader")
+	if len(reader) == 0 {
+		reader = owner
+	}
+	garage := args.Search("garage")
+	if len(garage) == 0 {
+		garage = owner
+	}
+	for _, id := range [][]byte{owner, reader, garage} {
+		_, contractID, _, err := cdb.GetValues(id)
+		if err != nil {
+			return nil, err
+		}
+		if contractID != byzcoin.ContractDarcID {
+			return nil, errors.New("the owner, reader and garage must be darcs")
+		}
+	}
+	ownerID := darc.NewIdentityDarc(owner).String()
+	if ownerID == car.Owner {
+		return nil, errors.New("the darc is already the owner of the car")
+	}
+
+	//evolving the car darc so that the rules point to the darcs of the new owner
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return nil, err
+	}
+	newDarc := carDarc.Copy()
+	err = newDarc.EvolveFrom(carDarc)
+	if err != nil {
+		return nil, err
+	}
+	type rule struct {
+		action darc.Action
+		id     darc.ID
+	}
+	rules := []rule{
+		{"spawn:calypsoRead", reader},
+		{"invoke:addReport", garage},
+		{"spawn:calypsoWrite", garage},
+		{"invoke:transferOwnership", owner},
+		{"invoke:grantRead", owner},
+		{"invoke:revokeRead", owner},
+		{"invoke:discloseField", owner},
+		{"invoke:approveAccess", owner},
+		{"invoke:denyAccess", owner},
+		{"invoke:grantAccess", owner},
+		{"invoke:revokeAccess", owner},
+	}
+	//the fields disclosed by the former owner can only be read by the new reader
+	for _, field := range SecretFields {
+		rules = append(rules, rule{darc.Action("invoke:" + FieldReadCommand(field)), reader})
+	}
+	for _, r := range rules {
+		expr := expression.InitAndExpr(darc.NewIdentityDarc(r.id).String())
+		if newDarc.Rules.Contains(r.action) {
+			err = newDarc.Rules.UpdateRule(r.action, expr)
+		} else {
+			err = newDarc.Rules.AddRule(r.action, expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	//the admin and the new garage can amend and retract the reports
+	amenders := expression.InitOrExpr(string(carDarc.Rules.Get("spawn:car")),
+		darc.NewIdentityDarc(garage).String())
+	//the admin and the new owner can change the status of the car
+	statusSetters := expression.InitOrExpr(string(carDarc.Rules.Get("spawn:car")),
+		darc.NewIdentityDarc(owner).String())
+	orRules := []struct {
+		action darc.Action
+		expr   expression.Expr
+	}{
+		{"invoke:amendReport", amenders},
+		{"invoke:retractReport", amenders},
+		{"invoke:setStatus", statusSetters},
+	}
+	for _, r := range orRules {
+		if newDarc.Rules.Contains(r.action) {
+			err = newDarc.Rules.UpdateRule(r.action, r.expr)
+		} else {
+			err = newDarc.Rules.AddRule(r.action, r.expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	newDarcBuf, err := newDarc.ToProto()
+	if err != nil {
+		return nil, err
+	}
+
+	if car.Owner != "" {
+		car.PreviousOwners = append(car.PreviousOwners, car.Owner)
+	}
+	car.Owner = ownerID
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, byzcoin.NewInstanceID(carDarcID),
+			byzcoin.ContractDarcID, newDarcBuf, carDarcID),
+	}, nil
+}
+
+// TransferOwnership gives the car to newOwner, where newReader and newGarage
+// become the only darcs allowed to read and add reports. The signers must
+// fulfil the invoke:transferOwnership rule of the car darc, which is
+// returned after its evolution.
+func (c *Client) TransferOwnership(instID byzcoin.InstanceID, controlDarc *darc.Darc,
+	newOwner, newReader, newGarage *darc.Darc, signers ...darc.Signer) (*darc.Darc, error) {
+
+	ctx := byzcoin.ClientTransaction{
+		Instructions: []byzcoin.Instruction{
+			newTransferInstruction(instID, newOwner.GetBaseID(),
+				newReader.GetBaseID(), newGarage.GetBaseID()),
+		},
+	}
+	err := ctx.Instructions[0].SignBy(controlDarc.GetBaseID(), signers...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetDarc(controlDarc.GetBaseID())
+}
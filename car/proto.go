@@ -1,33 +1,429 @@
 package car
 
+import (
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+)
+
 // PROTOSTART
 // package car;
 // type :time.Time:sfixed64
+// type :skipchain.SkipBlockID:bytes
+// type :darc.ID:bytes
+// import "darc.proto";
+// import "byzcoin.proto";
 //
 // option java_package = "ch.epfl.dedis.template.proto";
 // option java_outer_classname = "CarProto";
 
 
 type Report struct {
-	Date string
+	// Timestamp is the time of the report in nanoseconds since the Unix
+	// epoch, verified by the contract
+	Timestamp int64
+	// GarageId is the identity of the garage darc of the car, the expression
+	// of its invoke:addReport rule
 	GarageId string
 	WriteInstanceID []byte
+	// MileageCommitment is the Pedersen commitment to the mileage
+	MileageCommitment []byte
+	// MileageProof is the encoded MileageProof showing that the mileage is
+	// not lower than the one of the previous report
+	MileageProof []byte
+	// Kind is the public category of the report, one of the Report* kinds
+	Kind string
+	// SignedBy is the identity of the member of the garage who signed the
+	// report
+	SignedBy string
+	// Amends links an amendment or a retraction to the original report, it
+	// is nil for the original reports
+	Amends *ReportRef
+	// Retraction is true if the report retracts the report in Amends
+	Retraction bool
+	// Note explains the amendment or the retraction
+	Note string
+	// FieldWrites are the Calypso writes of the groups of fields of the
+	// secret, if the secret is not in WriteInstanceID
+	FieldWrites []FieldWrite
+	// RecallID is the recall instance closed for the car by a report of
+	// kind ReportRecall
+	// optional
+	RecallID []byte
+}
+
+// FieldWrite is the Calypso write holding one group of fields of the
+// secret, one of the SecretFields.
+type FieldWrite struct {
+	Field string
+	WriteInstanceID []byte
+}
+
+// ReportRef points to a report of the car by its index and its hash.
+type ReportRef struct {
+	Index uint32
+	Hash []byte
+}
+
+// ReportState is stored at ReportStateID for the original reports which are
+// amended or retracted.
+type ReportState struct {
+	// Amended is true if Amendment is the index of the last amendment
+	Amended bool
+	Amendment uint32
+	Retracted bool
 }
 
 type Car struct {
 	Vin string
-	Reports []Report
+	// ReportCount is the number of reports of the car, stored in their own
+	// instances at ReportInstanceID
+	ReportCount uint32
+	// Owner is the identity of the darc of the current owner
+	Owner string
+	// PreviousOwners lists the identities of all the former owners, the
+	// first owner comes first
+	PreviousOwners []string
+	// LastTimestamp is the timestamp of the last report
+	LastTimestamp int64
+	// MileageCommitment is the commitment to the mileage of the last report
+	// of the effective history
+	MileageCommitment []byte
+	// Status is the lifecycle state of the car, one of the Status* states
+	Status string
+	// Metadata is the public description of the car, set by the admin
+	Metadata CarMetadata
+	// GrantReaders lists the identities which were given a read grant, so
+	// that the reads with their grants can be found
+	GrantReaders []string
+}
+
+// CarMetadata describes the car to anybody, without giving access to the
+// reports. The empty fields are unknown.
+type CarMetadata struct {
+	Make string
+	Model string
+	ModelYear uint32
+	// FuelType is one of the Fuel* types
+	FuelType string
+	// FirstRegistration is the date of the first registration of the car,
+	// in seconds since the Unix epoch
+	FirstRegistration int64
+	Colour string
+}
+
+// CertifiedGarage is the entry of the registry of the certified garages,
+// stored at CertifiedGarageID(GarageDarcID).
+type CertifiedGarage struct {
+	GarageDarcID darc.ID
+	Name string
+	Licence string
+	Address string
+	// ValidFrom and ValidUntil bound the certification, in seconds since the
+	// Unix epoch
+	ValidFrom int64
+	ValidUntil int64
+	Revoked bool
+}
+
+// ReadGrant lets Reader read the reports of the car until Expiry, stored at
+// ReadGrantID(CarInstanceID, Reader).
+type ReadGrant struct {
+	CarInstanceID []byte
+	// Reader is the identity allowed to read, it can be a darc
+	Reader string
+	// Expiry is the end of the grant, in seconds since the Unix epoch
+	Expiry int64
+	// Owner is the owner of the car who gave the grant, the grant ends if
+	// the car changes owner
+	Owner string
+}
+
+// AccessRequest is the request of a buyer or an insurer to read the reports
+// of a car, which the owner of the car approves or denies.
+type AccessRequest struct {
+	CarInstanceID []byte
+	// Requester is the identity of the darc the request was spawned from
+	Requester string
+	// Scope is either ScopeReports or one of the SecretFields
+	Scope string
+	Reason string
+	// Status is RequestPending, RequestApproved or RequestDenied
+	Status string
+	// Owner is the owner of the car when the request was made, only this
+	// owner can approve it
+	Owner string
+	// Expiry is the end of the read grant of an approved request for
+	// ScopeReports, in seconds since the Unix epoch
+	// optional
+	Expiry int64
+}
+
+// PendingRequests lists the access requests waiting for an owner, stored at
+// PendingRequestsID(owner).
+type PendingRequests struct {
+	RequestIDs [][]byte
+}
+
+// Recall is a recall campaign of a manufacturer, for the listed VINs and
+// the VINs starting with one of the prefixes.
+type Recall struct {
+	// Manufacturer is the identity of the darc the recall was spawned from
+	Manufacturer string
+	Description string
+	Vins []string
+	VinPrefixes []string
+	// Closures are the cars where a garage reported the recall work
+	Closures []RecallClosure
+}
+
+// RecallClosure is the report closing a recall for one car.
+type RecallClosure struct {
+	Vin string
+	CarInstanceID []byte
+	// ReportIndex is the index of the report in the history of the car
+	ReportIndex uint32
+	// Timestamp is the time of the report, in nanoseconds since the Unix
+	// epoch
+	Timestamp int64
+	// GarageId is the identity of the garage which did the recall work
+	GarageId string
+}
+
+// RecallList lists the recalls naming a VIN or a VIN prefix, stored at
+// RecallListID(VIN or prefix).
+type RecallList struct {
+	RecallIDs [][]byte
+}
+
+// VinRecord is the entry of the VIN registry, stored at VinInstanceID(Vin).
+type VinRecord struct {
+	Vin string
+	CarInstanceID []byte
 }
 
 type SecretData struct {
-	ECOScore string
-	Mileage string
+	// Version of the schema, SecretDataVersion for new secrets
+	Version uint32
+	// ECOScore is the emissions score given during the check
+	ECOScore uint32
+	// Mileage is the reading of the odometer, in MileageUnit
+	Mileage uint64
+	// MileageUnit is either "km" or "mi"
+	MileageUnit string
+	// ServiceDate is the date of the check, in seconds since the Unix epoch
+	ServiceDate int64
 	Warranty bool
 	CheckNote string
+	// MileageBlinding is the blinding factor of the mileage commitment
+	MileageBlinding []byte
+	// Kind is the category of the report, the same as in the Report
+	Kind string
+	// The payload of the kind of the report, only the one of Kind is set
+	// optional
+	Inspection *InspectionData
+	// optional
+	Accident *AccidentData
+	// optional
+	Recall *RecallData
+	// optional
+	TyreChange *TyreChangeData
+}
+
+// InspectionData is the payload of an inspection report.
+type InspectionData struct {
+	Passed bool
+	Defects []string
+}
+
+// AccidentData is the payload of an accident report.
+type AccidentData struct {
+	DamagedParts []string
+	// RepairCost is in cents of Currency
+	RepairCost uint64
+	Currency string
+}
+
+// RecallData is the payload of a report about a recall campaign.
+type RecallData struct {
+	Campaign string
+	Done bool
+}
+
+// TyreChangeData is the payload of a tyre change report.
+type TyreChangeData struct {
+	// Positions of the changed tyres, like "front left"
+	Positions []string
+	Size string
+}
+
+// MileageProof is a range proof showing that the difference between two
+// mileage commitments is a positive number. Bits are the commitments to the
+// bits of the difference, the other fields hold the OR-proofs that each of
+// them is a commitment to 0 or 1.
+type MileageProof struct {
+	Bits []kyber.Point
+	C0 []kyber.Scalar
+	C1 []kyber.Scalar
+	S0 []kyber.Scalar
+	S1 []kyber.Scalar
+}
+
+// RegisterCar asks the service to spawn a new car instance from the car
+// darc. If Signatures is empty, the reply only holds the digest the Signers
+// have to sign.
+type RegisterCar struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarDarcID darc.ID
+	Car Car
+	Signers []darc.Identity
+	Signatures [][]byte
 }
 
+// RegisterCarReply holds the digest to sign or the ID of the new car instance.
+type RegisterCarReply struct {
+	// optional
+	Digest []byte
+	// optional
+	InstanceID []byte
+}
+
+// AddReport asks the service to store the Calypso write holding the
+// encrypted SecretData and then to add the report to the car instance.
+// Each of the two instructions is signed by the Signers, which first get
+// WriteDigest and then ReportDigest in the reply. The service sets the
+// GarageId of the report and, if missing, attributes it to the first signer.
+type AddReport struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarInstanceID []byte
+	CarDarcID darc.ID
+	Write []byte
+	Report Report
+	Signers []darc.Identity
+	WriteSignatures [][]byte
+	ReportSignatures [][]byte
+}
 
+// AddReportReply holds the digests to sign and the ID of the write instance.
+type AddReportReply struct {
+	// optional
+	WriteDigest []byte
+	// optional
+	ReportDigest []byte
+	// optional
+	WriteInstanceID []byte
+}
 
-//todo send prop
-//todo list prop
-//todo repl
\ No newline at end of file
+// GetReports returns the car stored in the car instance, with a page of its
+// reports: the reports with an index from From to From+Count-1.
+type GetReports struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarInstanceID []byte
+	// Kind only keeps the reports of this kind, if not empty
+	// optional
+	Kind string
+	// optional
+	From uint32
+	// Count is the number of reports of the page, at most MaxReportsPage
+	// optional
+	Count uint32
+}
+
+// GetReportsReply holds the car stored in the car instance, with the page of
+// the audit trail of the reports, and the effective history of the original
+// reports of this page.
+type GetReportsReply struct {
+	Car Car
+	Reports []Report
+	Effective []Report
+}
+
+// ReadRequest asks the service to spawn a Calypso read instance for the
+// write instance of a report, re-encrypting the secret to Xc. If Signatures
+// is empty, the reply only holds the digest the Signers have to sign.
+type ReadRequest struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarDarcID darc.ID
+	WriteInstanceID []byte
+	Xc kyber.Point
+	Signers []darc.Identity
+	Signatures [][]byte
+}
+
+// ReadRequestReply holds the digest to sign or the ID of the read instance.
+type ReadRequestReply struct {
+	// optional
+	Digest []byte
+	// optional
+	InstanceID []byte
+}
+
+// GetReportEnvelope returns the encrypted SecretData of a report together
+// with the symmetric key re-encrypted to the reader of the read instance.
+type GetReportEnvelope struct {
+	ByzCoinID skipchain.SkipBlockID
+	WriteInstanceID []byte
+	ReadInstanceID []byte
+}
+
+// GetReportEnvelopeReply can be opened with DecryptEnvelope by the reader.
+type GetReportEnvelopeReply struct {
+	Data []byte
+	Cs []kyber.Point
+	XhatEnc kyber.Point
+	X kyber.Point
+}
+
+// LookupVin returns the car instance registered with the VIN.
+type LookupVin struct {
+	ByzCoinID skipchain.SkipBlockID
+	Vin string
+}
+
+// LookupVinReply holds the IDs of the car instance and of the car darc, and
+// the proof of the registry entry, to be checked with VerifyVinProof. Status
+// and Metadata are the current status and description of the car.
+type LookupVinReply struct {
+	CarInstanceID []byte
+	CarDarcID darc.ID
+	Proof byzcoin.Proof
+	Status string
+	Metadata CarMetadata
+}
+
+// SetCarStatus asks the service to move the car to another state of its
+// lifecycle. If Signatures is empty, the reply only holds the digest the
+// Signers have to sign.
+type SetCarStatus struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarInstanceID []byte
+	CarDarcID darc.ID
+	Status string
+	Signers []darc.Identity
+	Signatures [][]byte
+}
+
+// SetCarStatusReply holds the digest to sign.
+type SetCarStatusReply struct {
+	// optional
+	Digest []byte
+}
+
+// UpdateCarMetadata asks the service to replace the public metadata of the
+// car. If Signatures is empty, the reply only holds the digest the Signers
+// have to sign.
+type UpdateCarMetadata struct {
+	ByzCoinID skipchain.SkipBlockID
+	CarInstanceID []byte
+	CarDarcID darc.ID
+	Metadata CarMetadata
+	Signers []darc.Identity
+	Signatures [][]byte
+}
+
+// UpdateCarMetadataReply holds the digest to sign.
+type UpdateCarMetadataReply struct {
+	// optional
+	Digest []byte
+}
@@ -0,0 +1,251 @@
+package car
+
+/*
+The reads.go decrypts many secrets at once. Instead of waiting for a block
+for every read instance, the read instances of all the write instances are
+spawned in a single transaction, and the re-encrypted keys are then asked
+to Calypso in parallel, so that reading the whole history of a car takes
+about one block interval.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+)
+
+// maxParallelDecryptions is the number of DecryptKey requests sent to
+// Calypso at the same time
+const maxParallelDecryptions = 8
+
+// decryptedWrite is the data of a write instance decrypted by a reader,
+// with the proof of the write and its symmetric key
+type decryptedWrite struct {
+	proof *byzcoin.Proof
+	key   []byte
+	data  []byte
+}
+
+// readSecrets decrypts the secrets of the reports, from their write
+// instances or the write instances of all their fields, with the key of the
+// reader. spawnReads spawns the read instances of all the write instances at
+// once, re-encrypting to the reader, and returns their IDs in the same order.
+func (c *Client) readSecrets(reports []Report, reader darc.Signer,
+	spawnReads func(writeIDs [][]byte) ([]byzcoin.InstanceID, error)) ([]SecretData, error) {
+
+	writes, err := c.readWrites(reports, reader, spawnReads)
+	if err != nil {
+		return nil, err
+	}
+	plainTexts := make([][]byte, len(writes))
+	for i, w := range writes {
+		plainTexts[i] = w.data
+	}
+	return decodeSecrets(reports, plainTexts)
+}
+
+// readWrites decrypts the write instances of the reports like readSecrets,
+// in the order of reportWriteIDs
+func (c *Client) readWrites(reports []Report, reader darc.Signer,
+	spawnReads func(writeIDs [][]byte) ([]byzcoin.InstanceID, error)) ([]decryptedWrite, error) {
+
+	writeIDs := reportWriteIDs(reports)
+	readIDs, err := spawnReads(writeIDs)
+	if err != nil {
+		return nil, err
+	}
+	return c.decryptAll(writeIDs, readIDs, reader)
+}
+
+// reportWriteIDs returns the write instances of the reports: the
+// WriteInstanceID of a report, or the writes of all its fields
+func reportWriteIDs(reports []Report) [][]byte {
+	var writeIDs [][]byte
+	for _, r := range reports {
+		if len(r.FieldWrites) == 0 {
+			writeIDs = append(writeIDs, r.WriteInstanceID)
+			continue
+		}
+		for _, fw := range r.FieldWrites {
+			writeIDs = append(writeIDs, fw.WriteInstanceID)
+		}
+	}
+	return writeIDs
+}
+
+// decodeSecrets decodes the secrets of the reports from the plain texts of
+// their write instances, in the order of reportWriteIDs
+func decodeSecrets(reports []Report, plainTexts [][]byte) ([]SecretData, error) {
+	secrets := make([]SecretData, len(reports))
+	next := 0
+	for i, r := range reports {
+		if len(r.FieldWrites) == 0 {
+			if next >= len(plainTexts) {
+				return nil, errors.New("missing the secret of a report")
+			}
+			secret, err := DecodeSecretData(plainTexts[next])
+			if err != nil {
+				return nil, err
+			}
+			secrets[i] = *secret
+			next++
+			continue
+		}
+		for _, fw := range r.FieldWrites {
+			if next >= len(plainTexts) {
+				return nil, errors.New("missing the secret of a field")
+			}
+			part, err := DecodeSecretPart(plainTexts[next], fw.Field)
+			if err != nil {
+				return nil, err
+			}
+			if err = secrets[i].SetPart(fw.Field, *part); err != nil {
+				return nil, err
+			}
+			next++
+		}
+		if err := secrets[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+// decryptWrites decrypts the data of the write instances, re-encrypted to
+// the reader by the read instances with the same index
+func (c *Client) decryptWrites(writeIDs [][]byte, readIDs []byzcoin.InstanceID,
+	reader darc.Signer) ([][]byte, error) {
+
+	writes, err := c.decryptAll(writeIDs, readIDs, reader)
+	if err != nil {
+		return nil, err
+	}
+	plainTexts := make([][]byte, len(writes))
+	for i, w := range writes {
+		plainTexts[i] = w.data
+	}
+	return plainTexts, nil
+}
+
+// decryptAll decrypts the write instances like decryptWrites, with at most
+// maxParallelDecryptions requests at the same time
+func (c *Client) decryptAll(writeIDs [][]byte, readIDs []byzcoin.InstanceID,
+	reader darc.Signer) ([]decryptedWrite, error) {
+
+	writes := make([]decryptedWrite, len(writeIDs))
+	errs := make([]error, len(writeIDs))
+	running := make(chan struct{}, maxParallelDecryptions)
+	var wg sync.WaitGroup
+	for i := range writeIDs {
+		wg.Add(1)
+		running <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			writes[i], errs[i] = c.decryptRead(writeIDs[i], readIDs[i], reader)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writes, nil
+}
+
+// decryptRead gets the proofs of the write and the read instances and
+// decrypts the key and the data of the write with the key of the reader
+func (c *Client) decryptRead(writeID []byte, readID byzcoin.InstanceID,
+	reader darc.Signer) (decryptedWrite, error) {
+
+	respWr, err := c.ByzCoin.GetProof(writeID)
+	if err != nil {
+		return decryptedWrite{}, err
+	}
+	respRe, err := c.ByzCoin.GetProof(readID.Slice())
+	if err != nil {
+		return decryptedWrite{}, err
+	}
+	key, err := c.decryptKey(&respWr.Proof, &respRe.Proof, reader)
+	if err != nil {
+		return decryptedWrite{}, err
+	}
+	data, err := decryptData(&respWr.Proof, key)
+	if err != nil {
+		return decryptedWrite{}, err
+	}
+	return decryptedWrite{proof: &respWr.Proof, key: key, data: data}, nil
+}
+
+// addReads spawns the Calypso read instances of the write instances in one
+// transaction, re-encrypting to the key of signerR, and returns their IDs
+func (c *Client) addReads(writeIDs [][]byte, controlDarc *darc.Darc,
+	signerR darc.Signer, signerO darc.Signer) ([]byzcoin.InstanceID, error) {
+
+	xc, err := readerPoint(signerR)
+	if err != nil {
+		return nil, err
+	}
+	ctx := byzcoin.ClientTransaction{}
+	for i, writeID := range writeIDs {
+		instr, err := newReadInstruction(byzcoin.NewInstanceID(writeID), xc)
+		if err != nil {
+			return nil, err
+		}
+		instr.Index = i
+		instr.Length = len(writeIDs)
+		ctx.Instructions = append(ctx.Instructions, instr)
+	}
+	return c.sendReads(ctx, controlDarc.GetBaseID(), []darc.Signer{signerR, signerO})
+}
+
+// invokeReads invokes the command spawning a read instance on the instance
+// once for each of the arguments, in one transaction, and returns the IDs of
+// the read instances
+func (c *Client) invokeReads(instID byzcoin.InstanceID, darcID darc.ID, command string,
+	args []byzcoin.Arguments, signers []darc.Signer) ([]byzcoin.InstanceID, error) {
+
+	ctx := byzcoin.ClientTransaction{}
+	for i := range args {
+		ctx.Instructions = append(ctx.Instructions, byzcoin.Instruction{
+			InstanceID: instID,
+			Nonce:      byzcoin.GenNonce(),
+			Index:      i,
+			Length:     len(args),
+			Invoke: &byzcoin.Invoke{
+				Command: command,
+				Args:    args[i],
+			},
+		})
+	}
+	return c.sendReads(ctx, darcID, signers)
+}
+
+// sendReads signs all the instructions of the transaction with the darc,
+// waits for the transaction to be added and returns the IDs of the read
+// instances spawned by the instructions
+func (c *Client) sendReads(ctx byzcoin.ClientTransaction, darcID darc.ID,
+	signers []darc.Signer) ([]byzcoin.InstanceID, error) {
+
+	if len(ctx.Instructions) == 0 {
+		return nil, nil
+	}
+	readIDs := make([]byzcoin.InstanceID, len(ctx.Instructions))
+	for i := range ctx.Instructions {
+		err := ctx.Instructions[i].SignBy(darcID, signers...)
+		if err != nil {
+			return nil, err
+		}
+		readIDs[i] = ctx.Instructions[i].DeriveID("")
+	}
+	_, err := c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	if err != nil {
+		return nil, err
+	}
+	return readIDs, nil
+}
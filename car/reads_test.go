@@ -0,0 +1,36 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSecrets(t *testing.T) {
+	sd := NewSecretData(ReportService, 1000, Kilometers)
+	whole, err := EncodeSecretData(&sd)
+	require.Nil(t, err)
+	reports := []Report{{WriteInstanceID: []byte("write")}, {}}
+	for _, field := range SecretFields {
+		reports[1].FieldWrites = append(reports[1].FieldWrites,
+			FieldWrite{Field: field, WriteInstanceID: []byte(field)})
+	}
+	plainTexts := [][]byte{whole}
+	for _, field := range SecretFields {
+		part, err := sd.Part(field)
+		require.Nil(t, err)
+		buf, err := EncodeSecretPart(&part, field)
+		require.Nil(t, err)
+		plainTexts = append(plainTexts, buf)
+	}
+	require.Equal(t, len(plainTexts), len(reportWriteIDs(reports)))
+
+	//the secret of a report by field is put back together
+	secrets, err := decodeSecrets(reports, plainTexts)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(secrets))
+	require.True(t, sameEncoding(&sd, &secrets[0]))
+	require.True(t, sameEncoding(&sd, &secrets[1]))
+	_, err = decodeSecrets(reports, plainTexts[:len(plainTexts)-1])
+	require.NotNil(t, err)
+}
@@ -0,0 +1,382 @@
+package car
+
+/*
+The recall.go lets the manufacturers flag recall campaigns on the cars. A
+manufacturer darc, spawned with SpawnManufacturerDarc, spawns a Recall naming
+the affected VINs and VIN prefixes, which is listed in the RecallList of
+each of them, so that anybody finds the recalls of a car by looking up its
+VIN and its prefixes. The recalls of different VINs and prefixes don't
+update the same list. A garage closes the recall for a car by
+adding a report of kind ReportRecall with the RecallID of the recall: the car
+contract then appends a RecallClosure to the recall, so the manufacturer sees
+when and by whom the work was done. A closure stays even if its report is
+later amended or retracted.
+*/
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/protobuf"
+)
+
+// ContractRecallID is the contract of the recall campaigns.
+var ContractRecallID = "recall"
+
+// ContractRecallListID is the contract of the lists of the recalls of a
+// VIN or of a VIN prefix, they are only created by the recall contract.
+var ContractRecallListID = "recallList"
+
+// RecallListID returns the ID of the list of the recalls naming the VIN or
+// the VIN prefix.
+func RecallListID(target string) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractRecallListID))
+	h.Write([]byte(target))
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// minVinPrefixLength is the length of the world manufacturer identifier, the
+// shortest prefix of a recall
+const minVinPrefixLength = 3
+
+// maxRecallVins is the largest number of VINs and prefixes of a recall
+const maxRecallVins = 1000
+
+// ValidateVinPrefix returns an error if the prefix is not the start of a
+// VIN, with at least the world manufacturer identifier.
+func ValidateVinPrefix(prefix string) error {
+	if len(prefix) < minVinPrefixLength || len(prefix) >= vinLength {
+		return errors.New("a VIN prefix must have between 3 and 16 characters")
+	}
+	for i := 0; i < len(prefix); i++ {
+		if _, err := vinValue(prefix[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the recall has no VIN or prefix, or if one
+// of them is not valid.
+func (r *Recall) Validate() error {
+	targets := len(r.Vins) + len(r.VinPrefixes)
+	if targets == 0 || targets > maxRecallVins {
+		return errors.New("a recall needs between 1 and 1000 VINs and prefixes")
+	}
+	for _, vin := range r.Vins {
+		if err := ValidateVin(vin); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range r.VinPrefixes {
+		if err := ValidateVinPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targets returns the distinct VINs and prefixes of the recall
+func (r *Recall) targets() []string {
+	var targets []string
+	seen := map[string]bool{}
+	for _, target := range append(append([]string{}, r.Vins...), r.VinPrefixes...) {
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// vinTargets returns the VIN and all its prefixes which can be named by a
+// recall
+func vinTargets(vin string) []string {
+	targets := []string{vin}
+	for n := minVinPrefixLength; n < len(vin); n++ {
+		targets = append(targets, vin[:n])
+	}
+	return targets
+}
+
+// Affects returns true if the VIN is in the recall or starts with one of its
+// prefixes.
+func (r *Recall) Affects(vin string) bool {
+	for _, v := range r.Vins {
+		if v == vin {
+			return true
+		}
+	}
+	for _, prefix := range r.VinPrefixes {
+		if strings.HasPrefix(vin, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClosedFor returns true if the recall was closed for the VIN.
+func (r *Recall) ClosedFor(vin string) bool {
+	for _, c := range r.Closures {
+		if c.Vin == vin {
+			return true
+		}
+	}
+	return false
+}
+
+// ContractRecall spawns the Recall in the "recall" argument from the darc of
+// the manufacturer. The recalls are only closed by the reports of the
+// garages, through the car contract.
+func ContractRecall(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	cIn []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+
+	cOut = cIn
+	err = inst.VerifyDarcSignature(cdb)
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		scs, err = spawnRecall(cdb, inst)
+		return
+	case byzcoin.InvokeType:
+		return nil, nil, errors.New("recalls can only be closed by the reports of the garages")
+	default:
+		return nil, nil, errors.New("recalls can't be deleted")
+	}
+}
+
+// spawnRecall stores the recall under the darc of the manufacturer and adds
+// it to the lists of the recalls of its VINs and prefixes
+func spawnRecall(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) ([]byzcoin.StateChange, error) {
+	if inst.Spawn.ContractID != ContractRecallID {
+		return nil, errors.New("can only spawn recalls")
+	}
+	var recall Recall
+	err := protobuf.Decode(inst.Spawn.Args.Search("recall"), &recall)
+	if err != nil {
+		return nil, errors.New("not a recall")
+	}
+	err = recall.Validate()
+	if err != nil {
+		return nil, err
+	}
+	recall.Manufacturer = darc.NewIdentityDarc(inst.InstanceID.Slice()).String()
+	recall.Closures = nil
+	recallBuf, err := protobuf.Encode(&recall)
+	if err != nil {
+		return nil, err
+	}
+
+	recallID := inst.DeriveID("")
+	darcID := darc.ID(inst.InstanceID.Slice())
+	scs := []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, recallID, ContractRecallID, recallBuf, darcID),
+	}
+	for _, target := range recall.targets() {
+		sc, err := addToRecallList(cdb, target, recallID, darcID)
+		if err != nil {
+			return nil, err
+		}
+		scs = append(scs, sc)
+	}
+	return scs, nil
+}
+
+// addToRecallList returns the state change adding the recall to the list of
+// the target, the list keeps the darc it was created with
+func addToRecallList(cdb byzcoin.ReadOnlyStateTrie, target string, recallID byzcoin.InstanceID,
+	darcID darc.ID) (byzcoin.StateChange, error) {
+
+	listID := RecallListID(target)
+	var list RecallList
+	action := byzcoin.Create
+	listBuf, _, listDarcID, errList := cdb.GetValues(listID.Slice())
+	if errList == nil {
+		action = byzcoin.Update
+		darcID = listDarcID
+		err := protobuf.Decode(listBuf, &list)
+		if err != nil {
+			return byzcoin.StateChange{}, err
+		}
+	}
+	list.RecallIDs = append(list.RecallIDs, recallID.Slice())
+	listBuf, err := protobuf.Encode(&list)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	return byzcoin.NewStateChange(action, listID, ContractRecallListID, listBuf, darcID), nil
+}
+
+// closeRecall returns the state change closing the recall of the report for
+// the car, the report being the next one of the car
+func (car *Car) closeRecall(cdb byzcoin.ReadOnlyStateTrie, carID byzcoin.InstanceID,
+	r Report) (byzcoin.StateChange, error) {
+
+	if r.Kind != ReportRecall {
+		return byzcoin.StateChange{}, errors.New("only a recall report can close a recall")
+	}
+	recallBuf, contractID, darcID, err := cdb.GetValues(r.RecallID)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if contractID != ContractRecallID {
+		return byzcoin.StateChange{}, errors.New("not a recall instance")
+	}
+	var recall Recall
+	err = protobuf.Decode(recallBuf, &recall)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if !recall.Affects(car.Vin) {
+		return byzcoin.StateChange{}, errors.New("the recall doesn't affect the car")
+	}
+	if recall.ClosedFor(car.Vin) {
+		return byzcoin.StateChange{}, errors.New("the recall is already closed for the car")
+	}
+	recall.Closures = append(recall.Closures, RecallClosure{
+		Vin:           car.Vin,
+		CarInstanceID: carID.Slice(),
+		ReportIndex:   car.ReportCount,
+		Timestamp:     r.Timestamp,
+		GarageId:      r.GarageId,
+	})
+	recallBuf, err = protobuf.Encode(&recall)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	return byzcoin.NewStateChange(byzcoin.Update, byzcoin.NewInstanceID(r.RecallID),
+		ContractRecallID, recallBuf, darcID), nil
+}
+
+// SpawnManufacturerDarc returns a transaction spawning the darc of a
+// manufacturer from an existing control darc, which can spawn recalls as
+// well as do everything a darc of SpawnDarc does.
+func SpawnManufacturerDarc(controlDarc *darc.Darc, idString string,
+	name string) (byzcoin.ClientTransaction, *darc.Darc, error) {
+
+	var ctx byzcoin.ClientTransaction
+	rs := darc.NewRules()
+	for _, action := range []darc.Action{"invoke:evolve", "_sign", "spawn:recall"} {
+		if err := rs.AddRule(action, expression.InitAndExpr(idString)); err != nil {
+			panic("add rule should never fail on an empty rule list: " + err.Error())
+		}
+	}
+	newDarc := darc.NewDarc(rs, []byte(name+" darc"))
+	newDarcBuf, err := newDarc.ToProto()
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx = newSpawnDarcTransaction(controlDarc, newDarcBuf)
+
+	return ctx, newDarc, err
+}
+
+// SpawnRecall spawns the recall of the VINs and the VIN prefixes and returns
+// its ID. The signers must fulfil the spawn:recall rule of the manufacturer
+// darc.
+func (c *Client) SpawnRecall(manufacturerDarc *darc.Darc, description string, vins []string,
+	prefixes []string, signers ...darc.Signer) (byzcoin.InstanceID, error) {
+
+	recall := Recall{Description: description}
+	for _, vin := range vins {
+		recall.Vins = append(recall.Vins, NormalizeVin(vin))
+	}
+	for _, prefix := range prefixes {
+		recall.VinPrefixes = append(recall.VinPrefixes, NormalizeVin(prefix))
+	}
+	err := recall.Validate()
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	recallBuf, err := protobuf.Encode(&recall)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	ctx := byzcoin.ClientTransaction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: byzcoin.NewInstanceID(manufacturerDarc.GetBaseID()),
+			Nonce:      byzcoin.GenNonce(),
+			Index:      0,
+			Length:     1,
+			Spawn: &byzcoin.Spawn{
+				ContractID: ContractRecallID,
+				Args:       byzcoin.Arguments{{Name: "recall", Value: recallBuf}},
+			},
+		}},
+	}
+	err = ctx.Instructions[0].SignBy(manufacturerDarc.GetBaseID(), signers...)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, 5)
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	return ctx.Instructions[0].DeriveID(""), nil
+}
+
+// GetRecall returns the recall, with the cars it was closed for.
+func (c *Client) GetRecall(recallID byzcoin.InstanceID) (*Recall, error) {
+	var recall Recall
+	err := c.getInstance(recallID, ContractRecallID, &recall)
+	if err != nil {
+		return nil, err
+	}
+	return &recall, nil
+}
+
+// GetOpenRecalls returns the IDs of the recalls affecting the car which are
+// not closed for it yet, and the recalls themselves. Only the lists of the
+// VIN of the car and of its prefixes are read.
+func (c *Client) GetOpenRecalls(instID byzcoin.InstanceID) ([]byzcoin.InstanceID, []Recall, error) {
+	car, err := c.GetCar(instID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []byzcoin.InstanceID
+	var recalls []Recall
+	seen := map[string]bool{}
+	for _, target := range vinTargets(car.Vin) {
+		var list RecallList
+		err = c.getInstance(RecallListID(target), ContractRecallListID, &list)
+		if err == errInstanceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range list.RecallIDs {
+			if seen[string(id)] {
+				continue
+			}
+			seen[string(id)] = true
+			recall, err := c.GetRecall(byzcoin.NewInstanceID(id))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !recall.ClosedFor(car.Vin) {
+				ids = append(ids, byzcoin.NewInstanceID(id))
+				recalls = append(recalls, *recall)
+			}
+		}
+	}
+	return ids, recalls, nil
+}
+
+// AddRecallReport adds a report of kind ReportRecall like AddReport, which
+// closes the recall for the car.
+func (c *Client) AddRecallReport(instID byzcoin.InstanceID, recallID byzcoin.InstanceID,
+	controlDarc *darc.Darc, wData SecretData, previous *SecretData,
+	signerG darc.Signer, signerO darc.Signer) error {
+
+	wData.Kind = ReportRecall
+	return c.addReport(instID, controlDarc, wData, previous, recallID.Slice(), signerG, signerO)
+}
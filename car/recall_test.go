@@ -0,0 +1,46 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateVinPrefix(t *testing.T) {
+	require.Nil(t, ValidateVinPrefix("1HG"))
+	require.Nil(t, ValidateVinPrefix("1HGCM82633A00435"))
+	require.NotNil(t, ValidateVinPrefix("1H"))
+	require.NotNil(t, ValidateVinPrefix("1HGCM82633A004352"))
+	require.NotNil(t, ValidateVinPrefix("1HGO"))
+}
+
+func TestRecall(t *testing.T) {
+	recall := Recall{Vins: []string{"1M8GDM9AXKP042788"}, VinPrefixes: []string{"1HGCM"}}
+	require.Nil(t, recall.Validate())
+	require.True(t, recall.Affects("1M8GDM9AXKP042788"))
+	require.True(t, recall.Affects("1HGCM82633A004352"))
+	require.False(t, recall.Affects("5YJ3E1EA7JF000001"))
+
+	require.False(t, recall.ClosedFor("1HGCM82633A004352"))
+	recall.Closures = append(recall.Closures, RecallClosure{Vin: "1HGCM82633A004352"})
+	require.True(t, recall.ClosedFor("1HGCM82633A004352"))
+
+	//a recall needs valid targets
+	require.NotNil(t, (&Recall{}).Validate())
+	require.NotNil(t, (&Recall{Vins: []string{"1HGCM82633A004353"}}).Validate())
+	require.NotNil(t, (&Recall{VinPrefixes: []string{"1"}}).Validate())
+}
+
+func TestRecallTargets(t *testing.T) {
+	recall := Recall{Vins: []string{"1M8GDM9AXKP042788", "1M8GDM9AXKP042788"}, VinPrefixes: []string{"1HGCM"}}
+	require.Equal(t, []string{"1M8GDM9AXKP042788", "1HGCM"}, recall.targets())
+
+	//the lists of a car are the ones of its VIN and of its prefixes
+	targets := vinTargets("1HGCM82633A004352")
+	require.Equal(t, 15, len(targets))
+	require.Equal(t, "1HGCM82633A004352", targets[0])
+	require.Contains(t, targets, "1HG")
+	require.Contains(t, targets, "1HGCM")
+	require.Contains(t, targets, "1HGCM82633A00435")
+	require.NotEqual(t, RecallListID("1HGCM"), RecallListID("1HGCM8"))
+}
@@ -0,0 +1,97 @@
+package car
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+)
+
+// The kinds of the reports. The kind is public, so that the reports can be
+// filtered without decrypting them, while the payload of the kind is in the
+// encrypted SecretData.
+const (
+	ReportService    = "service"
+	ReportInspection = "inspection"
+	ReportAccident   = "accident"
+	ReportRecall     = "recall"
+	ReportTyreChange = "tyreChange"
+)
+
+// ValidateReportKind returns an error if kind is not one of the Report* kinds.
+func ValidateReportKind(kind string) error {
+	switch kind {
+	case ReportService, ReportInspection, ReportAccident, ReportRecall, ReportTyreChange:
+		return nil
+	}
+	return fmt.Errorf("unknown kind of report %q", kind)
+}
+
+// ReportsOfKind returns the reports with the given kind, or all of them if
+// kind is empty.
+func ReportsOfKind(all []Report, kind string) []Report {
+	if kind == "" {
+		return all
+	}
+	var reports []Report
+	for _, r := range all {
+		if r.Kind == kind {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+// reportTimeWindow is how far the timestamp of a new report may be from the
+// clock of the conodes running the contract.
+const reportTimeWindow = 5 * time.Minute
+
+// Time returns the timestamp of the report.
+func (r *Report) Time() time.Time {
+	return time.Unix(0, r.Timestamp)
+}
+
+// verifyTimestamp checks that the timestamp of the report is within
+// reportTimeWindow of now and not before the last report of the car, so that
+// the reports are ordered by time.
+func (car *Car) verifyTimestamp(r Report, now time.Time) error {
+	t := r.Time()
+	if t.Before(now.Add(-reportTimeWindow)) || t.After(now.Add(reportTimeWindow)) {
+		return errors.New("the timestamp of the report is too far from the current time")
+	}
+	if r.Timestamp < car.LastTimestamp {
+		return errors.New("the report is older than the last report of the car")
+	}
+	return nil
+}
+
+// verifyGarage checks that GarageId is the garage allowed to add reports to
+// the car and that SignedBy is a member of this garage who signed the
+// instruction.
+func verifyGarage(cdb byzcoin.ReadOnlyStateTrie, carDarcID darc.ID, r Report,
+	signatures []darc.Signature) error {
+
+	carDarc, err := loadDarc(cdb, carDarcID)
+	if err != nil {
+		return err
+	}
+	garage := carDarc.Rules.Get("invoke:addReport")
+	if r.GarageId != string(garage) {
+		return errors.New("the report must be attributed to the garage of the car")
+	}
+	signed := false
+	for _, sig := range signatures {
+		if sig.Signer.String() == r.SignedBy {
+			signed = true
+		}
+	}
+	if !signed {
+		return errors.New("the report must be signed by the member of the garage in SignedBy")
+	}
+	if darc.EvalExpr(garage, darcGetter(cdb), r.SignedBy) != nil {
+		return errors.New("the signer of the report is not a member of the garage")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package car
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportsOfKind(t *testing.T) {
+	reports := []Report{{Kind: ReportService}, {Kind: ReportAccident}, {Kind: ReportService}}
+	require.Equal(t, 3, len(ReportsOfKind(reports, "")))
+	require.Equal(t, 2, len(ReportsOfKind(reports, ReportService)))
+	require.Equal(t, 1, len(ReportsOfKind(reports, ReportAccident)))
+	require.Equal(t, 0, len(ReportsOfKind(reports, ReportRecall)))
+	require.NotNil(t, ValidateReportKind("oilChange"))
+}
+
+func TestSecretData_Payload(t *testing.T) {
+	sd := NewSecretData(ReportInspection, 100000, Kilometers)
+	require.NotNil(t, sd.Validate())
+	sd.Inspection = &InspectionData{Passed: false, Defects: []string{"brakes"}}
+	require.Nil(t, sd.Validate())
+	sd.TyreChange = &TyreChangeData{Positions: []string{"front left"}, Size: "205/55 R16"}
+	require.NotNil(t, sd.Validate())
+
+	sd = NewSecretData(ReportService, 100000, Kilometers)
+	sd.Recall = &RecallData{Campaign: "airbag"}
+	require.NotNil(t, sd.Validate())
+	sd.Recall = nil
+	require.Nil(t, sd.Validate())
+
+	//the payload survives the encoding
+	sd = NewSecretData(ReportAccident, 100000, Kilometers)
+	sd.Accident = &AccidentData{DamagedParts: []string{"bumper", "hood"}, RepairCost: 250000, Currency: "CHF"}
+	buf, err := EncodeSecretData(&sd)
+	require.Nil(t, err)
+	sd2, err := DecodeSecretData(buf)
+	require.Nil(t, err)
+	require.Equal(t, sd.Accident, sd2.Accident)
+	require.Nil(t, sd2.Inspection)
+}
+
+func TestCar_verifyTimestamp(t *testing.T) {
+	now := time.Now()
+	var car Car
+	r := Report{Timestamp: now.UnixNano()}
+	require.Nil(t, car.verifyTimestamp(r, now))
+	require.NotNil(t, car.verifyTimestamp(Report{Timestamp: now.Add(-time.Hour).UnixNano()}, now))
+	require.NotNil(t, car.verifyTimestamp(Report{Timestamp: now.Add(time.Hour).UnixNano()}, now))
+	require.NotNil(t, car.verifyTimestamp(Report{}, now))
+
+	//the reports have to be in order
+	car.LastTimestamp = r.Timestamp
+	require.Nil(t, car.verifyTimestamp(Report{Timestamp: now.Add(time.Second).UnixNano()}, now))
+	require.NotNil(t, car.verifyTimestamp(Report{Timestamp: now.Add(-time.Second).UnixNano()}, now))
+	require.True(t, r.Time().Equal(now))
+}
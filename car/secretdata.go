@@ -0,0 +1,236 @@
+package car
+
+/*
+The secretdata.go defines the schema of the SecretData stored encrypted in the
+Calypso write instance of each report. The schema is versioned, so that the
+clients in other languages know how to interpret the secrets they read.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/protobuf"
+)
+
+// SecretDataVersion is the version of the SecretData schema written by this
+// package.
+const SecretDataVersion = 1
+
+// The units the mileage can be given in.
+const (
+	Kilometers = "km"
+	Miles      = "mi"
+)
+
+// maxMileage is the biggest mileage a car can have, in any unit
+const maxMileage = 10000000
+
+// The groups of fields of the SecretData which can be encrypted in their own
+// Calypso write, so that they can be disclosed separately. Every part holds
+// the Version and the Kind of the secret.
+const (
+	// FieldMileage holds the mileage, its unit and blinding factor and the
+	// date of the service
+	FieldMileage = "mileage"
+	// FieldPayload holds the payload of the kind of the report
+	FieldPayload = "payload"
+	// FieldEmissions holds the ECOScore
+	FieldEmissions = "emissions"
+	// FieldNotes holds the warranty and the note of the garage
+	FieldNotes = "notes"
+)
+
+// SecretFields lists all the groups of fields of the SecretData.
+var SecretFields = []string{FieldMileage, FieldPayload, FieldEmissions, FieldNotes}
+
+// NewSecretData returns the secret of a report of the given kind and mileage,
+// done at the current time. The payload of the kind has to be added, except
+// for ReportService.
+func NewSecretData(kind string, mileage uint64, unit string) SecretData {
+	return SecretData{
+		Version:     SecretDataVersion,
+		Kind:        kind,
+		Mileage:     mileage,
+		MileageUnit: unit,
+		ServiceDate: time.Now().Unix(),
+	}
+}
+
+// Validate checks that the secret follows the schema.
+func (sd *SecretData) Validate() error {
+	if sd.Version != SecretDataVersion {
+		return fmt.Errorf("unsupported version %d of the secret data", sd.Version)
+	}
+	if err := sd.validatePayload(); err != nil {
+		return err
+	}
+	return sd.validateMileage()
+}
+
+// validateMileage checks the unit and the range of the mileage and the date
+func (sd *SecretData) validateMileage() error {
+	if sd.MileageUnit != Kilometers && sd.MileageUnit != Miles {
+		return fmt.Errorf("unknown mileage unit %q", sd.MileageUnit)
+	}
+	if sd.Mileage > maxMileage {
+		return errors.New("the mileage is too big")
+	}
+	if sd.ServiceDate <= 0 {
+		return errors.New("need the date of the service")
+	}
+	return nil
+}
+
+// validatePayload checks that only the payload of the kind is set
+func (sd *SecretData) validatePayload() error {
+	if err := ValidateReportKind(sd.Kind); err != nil {
+		return err
+	}
+	payloads := map[string]bool{
+		ReportInspection: sd.Inspection != nil,
+		ReportAccident:   sd.Accident != nil,
+		ReportRecall:     sd.Recall != nil,
+		ReportTyreChange: sd.TyreChange != nil,
+	}
+	for kind, set := range payloads {
+		if kind == sd.Kind && !set {
+			return fmt.Errorf("need the payload of the %s report", kind)
+		}
+		if kind != sd.Kind && set {
+			return fmt.Errorf("a %s report can't hold the payload of a %s report", sd.Kind, kind)
+		}
+	}
+	return nil
+}
+
+// MileageKm returns the mileage in kilometers, rounded down.
+func (sd *SecretData) MileageKm() uint64 {
+	if sd.MileageUnit == Miles {
+		return sd.Mileage * 1609344 / 1000000
+	}
+	return sd.Mileage
+}
+
+// EncodeSecretData checks the secret and returns its protobuf encoding.
+func EncodeSecretData(sd *SecretData) ([]byte, error) {
+	if err := sd.Validate(); err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(sd)
+}
+
+// DecodeSecretData decodes the secret and checks that it follows the schema.
+func DecodeSecretData(buf []byte) (*SecretData, error) {
+	var sd SecretData
+	err := protobuf.Decode(buf, &sd)
+	if err != nil {
+		return nil, errors.New("not a secret data: " + err.Error())
+	}
+	if err = sd.Validate(); err != nil {
+		return nil, err
+	}
+	return &sd, nil
+}
+
+// copyField copies the fields of the group from src to dst
+func copyField(dst, src *SecretData, field string) error {
+	switch field {
+	case FieldMileage:
+		dst.Mileage = src.Mileage
+		dst.MileageUnit = src.MileageUnit
+		dst.MileageBlinding = src.MileageBlinding
+		dst.ServiceDate = src.ServiceDate
+	case FieldPayload:
+		dst.Inspection = src.Inspection
+		dst.Accident = src.Accident
+		dst.Recall = src.Recall
+		dst.TyreChange = src.TyreChange
+	case FieldEmissions:
+		dst.ECOScore = src.ECOScore
+	case FieldNotes:
+		dst.Warranty = src.Warranty
+		dst.CheckNote = src.CheckNote
+	default:
+		return fmt.Errorf("unknown field of the secret data %q", field)
+	}
+	return nil
+}
+
+// Part returns the part of the secret holding only the fields of the group.
+func (sd *SecretData) Part(field string) (SecretData, error) {
+	part := SecretData{Version: sd.Version, Kind: sd.Kind}
+	err := copyField(&part, sd, field)
+	return part, err
+}
+
+// SetPart copies the fields of the group from the part, which must have the
+// same version and kind as the fields already set.
+func (sd *SecretData) SetPart(field string, part SecretData) error {
+	if sd.Version == 0 {
+		sd.Version = part.Version
+		sd.Kind = part.Kind
+	}
+	if part.Version != sd.Version || part.Kind != sd.Kind {
+		return errors.New("the parts are not from the same secret data")
+	}
+	return copyField(sd, &part, field)
+}
+
+// ValidatePart checks that the part only holds the fields of the group and
+// that they follow the schema.
+func (sd *SecretData) ValidatePart(field string) error {
+	if sd.Version != SecretDataVersion {
+		return fmt.Errorf("unsupported version %d of the secret data", sd.Version)
+	}
+	if err := ValidateReportKind(sd.Kind); err != nil {
+		return err
+	}
+	part, err := sd.Part(field)
+	if err != nil {
+		return err
+	}
+	sdBuf, err := protobuf.Encode(sd)
+	if err != nil {
+		return err
+	}
+	partBuf, err := protobuf.Encode(&part)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sdBuf, partBuf) {
+		return fmt.Errorf("the part holds other fields than the %s", field)
+	}
+	switch field {
+	case FieldMileage:
+		return sd.validateMileage()
+	case FieldPayload:
+		return sd.validatePayload()
+	}
+	return nil
+}
+
+// EncodeSecretPart checks the part of the secret and returns its protobuf
+// encoding.
+func EncodeSecretPart(sd *SecretData, field string) ([]byte, error) {
+	if err := sd.ValidatePart(field); err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(sd)
+}
+
+// DecodeSecretPart decodes the part of the secret and checks that it only
+// holds the fields of the group.
+func DecodeSecretPart(buf []byte, field string) (*SecretData, error) {
+	var sd SecretData
+	err := protobuf.Decode(buf, &sd)
+	if err != nil {
+		return nil, errors.New("not a secret data: " + err.Error())
+	}
+	if err = sd.ValidatePart(field); err != nil {
+		return nil, err
+	}
+	return &sd, nil
+}
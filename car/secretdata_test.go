@@ -0,0 +1,73 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretData_Encode(t *testing.T) {
+	sd := NewSecretData(ReportService, 62000, Miles)
+	sd.ECOScore = 2310
+	sd.CheckNote = "new tires"
+	buf, err := EncodeSecretData(&sd)
+	require.Nil(t, err)
+	sd2, err := DecodeSecretData(buf)
+	require.Nil(t, err)
+	require.Equal(t, sd.Version, sd2.Version)
+	require.Equal(t, sd.ECOScore, sd2.ECOScore)
+	require.Equal(t, sd.Mileage, sd2.Mileage)
+	require.Equal(t, sd.MileageUnit, sd2.MileageUnit)
+	require.Equal(t, sd.ServiceDate, sd2.ServiceDate)
+	require.Equal(t, sd.CheckNote, sd2.CheckNote)
+	require.Equal(t, uint64(99779), sd2.MileageKm())
+
+	//secrets not following the schema are refused
+	sd.MileageUnit = "furlong"
+	_, err = EncodeSecretData(&sd)
+	require.NotNil(t, err)
+	sd.MileageUnit = Kilometers
+	sd.Version = SecretDataVersion + 1
+	buf, err = protobuf.Encode(&sd)
+	require.Nil(t, err)
+	_, err = DecodeSecretData(buf)
+	require.NotNil(t, err)
+	_, err = DecodeSecretData([]byte("100 000"))
+	require.NotNil(t, err)
+}
+
+func TestSecretData_Part(t *testing.T) {
+	sd := NewSecretData(ReportService, 62000, Miles)
+	sd.ECOScore = 2310
+	sd.CheckNote = "new tires"
+
+	//every part only holds its own fields
+	var joined SecretData
+	for _, field := range SecretFields {
+		part, err := sd.Part(field)
+		require.Nil(t, err)
+		buf, err := EncodeSecretPart(&part, field)
+		require.Nil(t, err)
+		part2, err := DecodeSecretPart(buf, field)
+		require.Nil(t, err)
+		require.Nil(t, joined.SetPart(field, *part2))
+	}
+	require.Nil(t, joined.Validate())
+	require.Equal(t, sd.Mileage, joined.Mileage)
+	require.Equal(t, sd.ECOScore, joined.ECOScore)
+	require.Equal(t, sd.CheckNote, joined.CheckNote)
+	mileage, err := sd.Part(FieldMileage)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), mileage.ECOScore)
+	require.Equal(t, "", mileage.CheckNote)
+
+	//parts holding other fields or from another secret are refused
+	require.NotNil(t, sd.ValidatePart(FieldMileage))
+	_, err = sd.Part("owner")
+	require.NotNil(t, err)
+	inspection := NewSecretData(ReportInspection, 62000, Miles)
+	other, err := inspection.Part(FieldNotes)
+	require.Nil(t, err)
+	require.NotNil(t, joined.SetPart(FieldNotes, other))
+}
@@ -0,0 +1,180 @@
+package car
+
+import (
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/suites"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var testInterval = 500 * time.Millisecond
+var tSuite = suites.MustFind("Ed25519")
+
+// ser is the test harness: it starts a local ByzCoin ledger with Calypso
+// and gives access to a Client for it.
+type ser struct {
+	local    *onet.LocalTest
+	servers    []*onet.Server
+	services []*byzcoin.Service
+	roster   *onet.Roster
+	signer   darc.Signer
+	gDarc    *darc.Darc
+	interval time.Duration
+
+	cl         *byzcoin.Client
+	gbReply    *byzcoin.CreateGenesisBlockResponse
+	genesisMsg *byzcoin.CreateGenesisBlock
+	servicesCal   []*calypso.Service
+	ltsReply   *calypso.CreateLTSReply
+	client     *Client
+}
+
+func (s *ser) service() *byzcoin.Service {
+	return s.services[0]
+}
+
+func registerCarContract(servers []*onet.Server) {
+	// For testing - there must be a better way to do that. But putting
+	// services []skipchain.GetService in the method signature doesn't work :(
+	for _, s := range servers {
+		byzcoin.RegisterContract(s, ContractCarID, ContractCar)
+		byzcoin.RegisterContract(s, ContractGarageRegistryID, ContractGarageRegistry)
+		byzcoin.RegisterContract(s, ContractReadGrantID, ContractReadGrant)
+		byzcoin.RegisterContract(s, ContractAccessRequestID, ContractAccessRequest)
+		byzcoin.RegisterContract(s, ContractRecallID, ContractRecall)
+	}
+}
+
+func newSer(t *testing.T, interval time.Duration) *ser {
+	return newSerN(t, interval, 4, false)
+}
+
+
+func newSerN(t *testing.T, interval time.Duration, nodes int, viewchange bool) *ser {
+	s := &ser{
+		local:  onet.NewLocalTestT(tSuite, t),
+		signer: darc.NewSignerEd25519(nil, nil),
+	}
+	s.servers, s.roster, _ = s.local.GenTree(nodes, true)
+
+	for _, sv := range s.local.GetServices(s.servers, byzcoin.ByzCoinID) {
+		service := sv.(*byzcoin.Service)
+		s.services = append(s.services, service)
+	}
+
+	services := s.local.GetServices(s.servers, onet.ServiceFactory.ServiceID(calypso.ServiceName))
+	for _, ser := range services {
+		s.servicesCal = append(s.servicesCal, ser.(*calypso.Service))
+	}
+
+	registerCarContract(s.servers)
+	s.createGenesis(t, interval)
+
+	var err error
+	// Start DKG
+	s.ltsReply, err = s.servicesCal[0].CreateLTS(&calypso.CreateLTS{Roster: *s.roster, BCID: s.gbReply.Skipblock.Hash})
+	require.Nil(t, err)
+
+	s.client = NewClientFromByzCoin(s.cl)
+	s.client.LTS = s.ltsReply
+
+	return s
+}
+
+func (s *ser) createGenesis(t *testing.T, interval time.Duration) {
+	var err error
+	s.genesisMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, s.roster,
+		[]string{"spawn:darc", "spawn:garageRegistry", "invoke:certifyGarage", "invoke:revokeGarage"},
+		s.signer.Identity())
+	require.Nil(t, err)
+	s.gDarc = &s.genesisMsg.GenesisDarc
+	s.genesisMsg.BlockInterval = interval
+	s.interval = s.genesisMsg.BlockInterval
+
+	s.cl, s.gbReply, err = byzcoin.NewLedger(s.genesisMsg, false)
+	require.Nil(t, err)
+}
+
+// certifyGarage creates the garage registry, controlled by the genesis darc,
+// if it doesn't exist yet and certifies the garage darc for a year
+func (s *ser) certifyGarage(t *testing.T, garage *darc.Darc) {
+	if _, err := s.client.GetCertifiedGarage(garage.GetBaseID()); err == nil {
+		return
+	}
+	resp, err := s.cl.GetProof(GarageRegistryID.Slice())
+	require.Nil(t, err)
+	if !resp.Proof.InclusionProof.Match(GarageRegistryID.Slice()) {
+		require.Nil(t, s.client.CreateGarageRegistry(s.gDarc, s.gDarc.GetBaseID(), s.signer))
+	}
+	now := time.Now()
+	require.Nil(t, s.client.CertifyGarage(s.gDarc, CertifiedGarage{
+		GarageDarcID: garage.GetBaseID(),
+		Name:         "Test garage",
+		Licence:      "CH-1234",
+		Address:      "Station 14, 1015 Lausanne",
+		ValidFrom:    now.Add(-time.Hour).Unix(),
+		ValidUntil:   now.AddDate(1, 0, 0).Unix(),
+	}, s.signer))
+}
+// testDarcs holds the darcs of the car structure used by the tests
+type testDarcs struct {
+	admin  darc.Signer
+	user   darc.Signer
+	Admin  *darc.Darc
+	User   *darc.Darc
+	Reader *darc.Darc
+	Garage *darc.Darc
+	Car    *darc.Darc
+}
+
+// spawnTestDarcs creates the admin, user, reader, garage and car darcs,
+// where the user is the only reader and garage of the car and the garage
+// is certified
+func (s *ser) spawnTestDarcs(t *testing.T) *testDarcs {
+	d := &testDarcs{
+		admin: darc.NewSignerEd25519(nil, nil),
+		user:  darc.NewSignerEd25519(nil, nil),
+	}
+	ctx, darcAdmin, err := SpawnAdminDarc(s.gDarc, d.admin)
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, s.signer, s.gDarc, byzcoin.NewInstanceID(darcAdmin.GetBaseID()).Slice())
+	require.Nil(t, err)
+	d.Admin = darcAdmin
+
+	ctx, d.User, err = SpawnDarc(d.Admin, d.user.Identity().String(), "User")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(d.User.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	ctx, d.Reader, err = SpawnDarc(d.Admin, d.User.GetIdentityString(), "Reader")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(d.Reader.GetBaseID()).Slice())
+	require.Nil(t, err)
+
+	ctx, d.Garage, err = SpawnDarc(d.Admin, d.User.GetIdentityString(), "Garage")
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(d.Garage.GetBaseID()).Slice())
+	require.Nil(t, err)
+	s.certifyGarage(t, d.Garage)
+
+	ctx, d.Car, err = SpawnCarDarc(d.Admin, d.User, d.Reader, d.Garage)
+	require.Nil(t, err)
+	_, err = s.client.SignAndSendTransaction(ctx, d.admin, d.Admin, byzcoin.NewInstanceID(d.Car.GetBaseID()).Slice())
+	require.Nil(t, err)
+	return d
+}
+
+// signDigest returns the signatures of the digest by all the signers
+func signDigest(t *testing.T, digest []byte, signers ...darc.Signer) [][]byte {
+	var sigs [][]byte
+	for _, signer := range signers {
+		sig, err := signer.Sign(digest)
+		require.Nil(t, err)
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
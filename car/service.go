@@ -1,35 +1,412 @@
 package car
 
+/*
+The service.go defines what to do for each API-call. The service runs on the
+conode and builds the ByzCoin instructions for the clients, so that thin
+clients only have to sign the digests it returns.
+*/
+
 import (
+	"errors"
+
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
 )
 
-
+// ServiceName is used for registration on the onet.
 var ServiceName = "Calypso_Car"
-// This service is only used because we need to register our contracts to
-// the ByzCoin service. So we create this stub and add contracts to it
-// from the `contracts` directory.
+
+// Used for tests
+var carServiceID onet.ServiceID
 
 func init() {
-	_, err := onet.RegisterNewService(ServiceName, newService)
+	var err error
+	carServiceID, err = onet.RegisterNewService(ServiceName, newService)
 	log.ErrFatal(err)
+	network.RegisterMessages(
+		RegisterCar{}, RegisterCarReply{},
+		AddReport{}, AddReportReply{},
+		GetReports{}, GetReportsReply{},
+		ReadRequest{}, ReadRequestReply{},
+		GetReportEnvelope{}, GetReportEnvelopeReply{},
+		LookupVin{}, LookupVinReply{},
+		SetCarStatus{}, SetCarStatusReply{},
+		UpdateCarMetadata{}, UpdateCarMetadataReply{},
+	)
 }
 
-// Service is only used to being able to store our contracts
+// Service registers the car contract and lets clients use it through the
+// API defined in proto.go.
 type Service struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
 	// are correctly handled.
 	*onet.ServiceProcessor
 }
 
+// RegisterCar spawns a new car instance.
+func (s *Service) RegisterCar(req *RegisterCar) (*RegisterCarReply, error) {
+	instr, err := newCarInstruction(req.Car, req.CarDarcID)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Signatures) == 0 {
+		digest, err := instructionDigest(&instr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return &RegisterCarReply{Digest: digest}, nil
+	}
+	err = addSignatures(&instr, req.CarDarcID, req.Signers, req.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sendInstruction(req.ByzCoinID, instr); err != nil {
+		return nil, err
+	}
+	return &RegisterCarReply{InstanceID: instr.DeriveID("").Slice()}, nil
+}
+
+// AddReport stores the Calypso write of the report and then adds the report
+// to the car instance. The request has to be sent three times: to get the
+// digest of the write, to get the digest of the report and to add the report.
+// As the write instance is only spawned if it is missing, the request can
+// be repeated safely.
+func (s *Service) AddReport(req *AddReport) (*AddReportReply, error) {
+	writeInstr := newWriteInstruction(req.CarDarcID, req.Write)
+	if len(req.WriteSignatures) == 0 {
+		digest, err := instructionDigest(&writeInstr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return &AddReportReply{WriteDigest: digest}, nil
+	}
+	err := addSignatures(&writeInstr, req.CarDarcID, req.Signers, req.WriteSignatures)
+	if err != nil {
+		return nil, err
+	}
+	writeID := writeInstr.DeriveID("")
+	pr, err := s.getProof(req.ByzCoinID, writeID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if !pr.InclusionProof.Match(writeID.Slice()) {
+		if err = s.sendInstruction(req.ByzCoinID, writeInstr); err != nil {
+			return nil, err
+		}
+	}
+
+	//the report is attributed to the garage of the car and to the first signer
+	carDarc, err := s.getDarc(req.ByzCoinID, req.CarDarcID)
+	if err != nil {
+		return nil, err
+	}
+	report := req.Report
+	report.WriteInstanceID = writeID.Slice()
+	report.GarageId = string(carDarc.Rules.Get("invoke:addReport"))
+	if report.SignedBy == "" && len(req.Signers) > 0 {
+		report.SignedBy = req.Signers[0].String()
+	}
+	reportInstr, err := newReportInstruction(byzcoin.NewInstanceID(req.CarInstanceID), report)
+	if err != nil {
+		return nil, err
+	}
+	reply := &AddReportReply{WriteInstanceID: writeID.Slice()}
+	if len(req.ReportSignatures) == 0 {
+		reply.ReportDigest, err = instructionDigest(&reportInstr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+	err = addSignatures(&reportInstr, req.CarDarcID, req.Signers, req.ReportSignatures)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sendInstruction(req.ByzCoinID, reportInstr); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetReports returns the car with a page of its reports and the effective
+// history of this page, only keeping the reports of the requested kind.
+func (s *Service) GetReports(req *GetReports) (*GetReportsReply, error) {
+	car, err := s.getCar(req.ByzCoinID, req.CarInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	count := req.Count
+	if count == 0 || count > MaxReportsPage {
+		count = MaxReportsPage
+	}
+	carID := byzcoin.NewInstanceID(req.CarInstanceID)
+	get := func(id byzcoin.InstanceID, contractID string, value interface{}) error {
+		pr, err := s.getProof(req.ByzCoinID, id.Slice())
+		if err != nil {
+			return err
+		}
+		return decodeInstance(pr, id, contractID, value)
+	}
+	trail, err := reportsPage(carID, car.ReportCount, req.From, count, get)
+	if err != nil {
+		return nil, err
+	}
+	effective, err := effectivePage(carID, req.From, trail, get)
+	if err != nil {
+		return nil, err
+	}
+	return &GetReportsReply{
+		Car:       *car,
+		Reports:   ReportsOfKind(trail, req.Kind),
+		Effective: ReportsOfKind(effective, req.Kind),
+	}, nil
+}
+
+// ReadRequest spawns a Calypso read instance for the write instance of a
+// report.
+func (s *Service) ReadRequest(req *ReadRequest) (*ReadRequestReply, error) {
+	if req.Xc == nil {
+		return nil, errors.New("need the public key of the reader")
+	}
+	instr, err := newReadInstruction(byzcoin.NewInstanceID(req.WriteInstanceID), req.Xc)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Signatures) == 0 {
+		digest, err := instructionDigest(&instr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return &ReadRequestReply{Digest: digest}, nil
+	}
+	err = addSignatures(&instr, req.CarDarcID, req.Signers, req.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sendInstruction(req.ByzCoinID, instr); err != nil {
+		return nil, err
+	}
+	return &ReadRequestReply{InstanceID: instr.DeriveID("").Slice()}, nil
+}
+
+// GetReportEnvelope returns the encrypted secret of a report with its key
+// re-encrypted to the reader.
+func (s *Service) GetReportEnvelope(req *GetReportEnvelope) (*GetReportEnvelopeReply, error) {
+	prWr, err := s.getProof(req.ByzCoinID, req.WriteInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	prRe, err := s.getProof(req.ByzCoinID, req.ReadInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := s.calypsoService().DecryptKey(&calypso.DecryptKey{Read: *prRe, Write: *prWr})
+	if err != nil {
+		return nil, err
+	}
+	_, value, _, _, err := prWr.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	var write calypso.Write
+	err = protobuf.DecodeWithConstructors(value, &write, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return &GetReportEnvelopeReply{
+		Data:    write.Data,
+		Cs:      dk.Cs,
+		XhatEnc: dk.XhatEnc,
+		X:       dk.X,
+	}, nil
+}
+
+// LookupVin returns the car instance registered with the VIN, with the proof
+// of the registry entry.
+func (s *Service) LookupVin(req *LookupVin) (*LookupVinReply, error) {
+	pr, err := s.getProof(req.ByzCoinID, VinInstanceID(req.Vin).Slice())
+	if err != nil {
+		return nil, err
+	}
+	record, darcID, err := VerifyVinProof(pr, req.ByzCoinID, req.Vin)
+	if err != nil {
+		return nil, err
+	}
+	car, err := s.getCar(req.ByzCoinID, record.CarInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &LookupVinReply{
+		CarInstanceID: record.CarInstanceID,
+		CarDarcID:     darcID,
+		Proof:         *pr,
+		Status:        car.Status,
+		Metadata:      car.Metadata,
+	}, nil
+}
+
+// SetCarStatus changes the status of the car instance.
+func (s *Service) SetCarStatus(req *SetCarStatus) (*SetCarStatusReply, error) {
+	if err := ValidateStatus(req.Status); err != nil {
+		return nil, err
+	}
+	instr := newStatusInstruction(byzcoin.NewInstanceID(req.CarInstanceID), req.Status)
+	if len(req.Signatures) == 0 {
+		digest, err := instructionDigest(&instr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return &SetCarStatusReply{Digest: digest}, nil
+	}
+	err := addSignatures(&instr, req.CarDarcID, req.Signers, req.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sendInstruction(req.ByzCoinID, instr); err != nil {
+		return nil, err
+	}
+	return &SetCarStatusReply{}, nil
+}
+
+// UpdateCarMetadata replaces the public metadata of the car instance.
+func (s *Service) UpdateCarMetadata(req *UpdateCarMetadata) (*UpdateCarMetadataReply, error) {
+	if err := req.Metadata.Validate(); err != nil {
+		return nil, err
+	}
+	instr, err := newMetadataInstruction(byzcoin.NewInstanceID(req.CarInstanceID), req.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Signatures) == 0 {
+		digest, err := instructionDigest(&instr, req.CarDarcID, req.Signers)
+		if err != nil {
+			return nil, err
+		}
+		return &UpdateCarMetadataReply{Digest: digest}, nil
+	}
+	err = addSignatures(&instr, req.CarDarcID, req.Signers, req.Signatures)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sendInstruction(req.ByzCoinID, instr); err != nil {
+		return nil, err
+	}
+	return &UpdateCarMetadataReply{}, nil
+}
+
+func (s *Service) byzcoinService() *byzcoin.Service {
+	return s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+}
+
+func (s *Service) calypsoService() *calypso.Service {
+	return s.Service(calypso.ServiceName).(*calypso.Service)
+}
+
+// getProof returns the proof for the key from the ByzCoin ledger
+func (s *Service) getProof(id skipchain.SkipBlockID, key []byte) (*byzcoin.Proof, error) {
+	resp, err := s.byzcoinService().GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     key,
+		ID:      id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Proof, nil
+}
+
+// getDarc returns the latest version of the darc from the ByzCoin ledger
+func (s *Service) getDarc(id skipchain.SkipBlockID, darcID darc.ID) (*darc.Darc, error) {
+	pr, err := s.getProof(id, darcID)
+	if err != nil {
+		return nil, err
+	}
+	if !pr.InclusionProof.Match(darcID) {
+		return nil, errors.New("darc not found")
+	}
+	_, value, _, _, err := pr.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	return darc.NewFromProtobuf(value)
+}
+
+// getCar returns the car stored in the car instance
+func (s *Service) getCar(id skipchain.SkipBlockID, instID []byte) (*Car, error) {
+	pr, err := s.getProof(id, instID)
+	if err != nil {
+		return nil, err
+	}
+	if !pr.InclusionProof.Match(instID) {
+		return nil, errors.New("car instance not found")
+	}
+	_, value, contractID, _, err := pr.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if contractID != ContractCarID {
+		return nil, errors.New("not a car instance")
+	}
+	var car Car
+	err = protobuf.Decode(value, &car)
+	if err != nil {
+		return nil, err
+	}
+	return &car, nil
+}
+
+// sendInstruction sends a transaction with the signed instruction to ByzCoin
+// and waits for it to be included in the ledger
+func (s *Service) sendInstruction(id skipchain.SkipBlockID, instr byzcoin.Instruction) error {
+	_, err := s.byzcoinService().AddTransaction(&byzcoin.AddTxRequest{
+		Version:     byzcoin.CurrentVersion,
+		SkipchainID: id,
+		Transaction: byzcoin.ClientTransaction{
+			Instructions: byzcoin.Instructions{instr},
+		},
+		InclusionWait: 5,
+	})
+	return err
+}
+
+// DecryptEnvelope decodes the key of the envelope with the private key of the
+// reader and returns the decrypted secret of the report.
+func DecryptEnvelope(env *GetReportEnvelopeReply, reader darc.Signer) (*SecretData, error) {
+	_, err := readerPoint(reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := calypso.DecodeKey(cothority.Suite, env.X, env.Cs, env.XhatEnc, reader.Ed25519.Secret)
+	if err != nil {
+		return nil, err
+	}
+	plainText, err := decrypt(env.Data, key)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeSecretData(plainText)
+}
 
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 	}
+	if err := s.RegisterHandlers(s.RegisterCar, s.AddReport, s.GetReports,
+		s.ReadRequest, s.GetReportEnvelope, s.LookupVin, s.SetCarStatus,
+		s.UpdateCarMetadata); err != nil {
+		return nil, errors.New("couldn't register messages")
+	}
 	byzcoin.RegisterContract(c, ContractCarID, ContractCar)
+	byzcoin.RegisterContract(c, ContractGarageRegistryID, ContractGarageRegistry)
+	byzcoin.RegisterContract(c, ContractReadGrantID, ContractReadGrant)
+	byzcoin.RegisterContract(c, ContractAccessRequestID, ContractAccessRequest)
+	byzcoin.RegisterContract(c, ContractRecallID, ContractRecall)
 	return s, nil
 }
-
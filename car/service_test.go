@@ -2,10 +2,131 @@ package car
 
 import (
 	"testing"
+	"time"
 
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet/log"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
+
+func TestService_API(t *testing.T) {
+	s := newSer(t, testInterval)
+	defer s.local.CloseAll()
+	d := s.spawnTestDarcs(t)
+	service := s.local.GetServices(s.servers, carServiceID)[0].(*Service)
+	bcID := s.gbReply.Skipblock.Hash
+
+	//registering the car, first getting the digest and then sending the signature
+	reqCar := &RegisterCar{
+		ByzCoinID: bcID,
+		CarDarcID: d.Car.GetBaseID(),
+		Car:       NewCar("1HGCM82633A004352"),
+		Signers:   []darc.Identity{d.admin.Identity()},
+	}
+	replyCar, err := service.RegisterCar(reqCar)
+	require.Nil(t, err)
+	require.Nil(t, replyCar.InstanceID)
+	reqCar.Signatures = signDigest(t, replyCar.Digest, d.admin)
+	replyCar, err = service.RegisterCar(reqCar)
+	require.Nil(t, err)
+	require.NotNil(t, replyCar.InstanceID)
+
+	replyVin, err := service.LookupVin(&LookupVin{ByzCoinID: bcID, Vin: reqCar.Car.Vin})
+	require.Nil(t, err)
+	require.Equal(t, replyCar.InstanceID, replyVin.CarInstanceID)
+	require.Equal(t, d.Car.GetBaseID(), replyVin.CarDarcID)
+	require.Equal(t, StatusActive, replyVin.Status)
+
+	//adding a report, the user is the only garage
+	wData := NewSecretData(ReportService, 100000, Kilometers)
+	wData.ECOScore = 2310
+	wData.Warranty = true
+	report := Report{Timestamp: time.Now().UnixNano(), Kind: ReportService}
+	require.Nil(t, report.CommitMileage(&wData, nil))
+	key := random.Bits(128, true, random.New())
+	writeBuf, err := newSecretWrite(key, wData, d.Car.GetBaseID(), s.ltsReply)
+	require.Nil(t, err)
+	reqReport := &AddReport{
+		ByzCoinID:     bcID,
+		CarInstanceID: replyCar.InstanceID,
+		CarDarcID:     d.Car.GetBaseID(),
+		Write:         writeBuf,
+		Report:        report,
+		Signers:       []darc.Identity{d.user.Identity()},
+	}
+	replyReport, err := service.AddReport(reqReport)
+	require.Nil(t, err)
+	reqReport.WriteSignatures = signDigest(t, replyReport.WriteDigest, d.user)
+	replyReport, err = service.AddReport(reqReport)
+	require.Nil(t, err)
+	require.NotNil(t, replyReport.WriteInstanceID)
+	reqReport.ReportSignatures = signDigest(t, replyReport.ReportDigest, d.user)
+	_, err = service.AddReport(reqReport)
+	require.Nil(t, err)
+
+	replyReports, err := service.GetReports(&GetReports{ByzCoinID: bcID, CarInstanceID: replyCar.InstanceID})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), replyReports.Car.ReportCount)
+	require.Equal(t, 1, len(replyReports.Reports))
+	require.Equal(t, 1, len(replyReports.Effective))
+	require.Equal(t, replyReport.WriteInstanceID, replyReports.Reports[0].WriteInstanceID)
+	require.Equal(t, d.Garage.GetIdentityString(), replyReports.Reports[0].GarageId)
+	require.Equal(t, d.user.Identity().String(), replyReports.Reports[0].SignedBy)
+	replyReports, err = service.GetReports(&GetReports{ByzCoinID: bcID, CarInstanceID: replyCar.InstanceID,
+		Kind: ReportInspection})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(replyReports.Reports))
+
+	//reading the report, re-encrypted to a key of the reader
+	reader := darc.NewSignerEd25519(nil, nil)
+	reqRead := &ReadRequest{
+		ByzCoinID:       bcID,
+		CarDarcID:       d.Car.GetBaseID(),
+		WriteInstanceID: replyReport.WriteInstanceID,
+		Xc:              reader.Ed25519.Point,
+		Signers:         []darc.Identity{d.user.Identity()},
+	}
+	replyRead, err := service.ReadRequest(reqRead)
+	require.Nil(t, err)
+	reqRead.Signatures = signDigest(t, replyRead.Digest, d.user)
+	replyRead, err = service.ReadRequest(reqRead)
+	require.Nil(t, err)
+
+	env, err := service.GetReportEnvelope(&GetReportEnvelope{
+		ByzCoinID:       bcID,
+		WriteInstanceID: replyReport.WriteInstanceID,
+		ReadInstanceID:  replyRead.InstanceID,
+	})
+	require.Nil(t, err)
+	secret, err := DecryptEnvelope(env, reader)
+	require.Nil(t, err)
+	require.Equal(t, wData.Mileage, secret.Mileage)
+
+	//the owner exports the car, the status is public
+	reqStatus := &SetCarStatus{
+		ByzCoinID:     bcID,
+		CarInstanceID: replyCar.InstanceID,
+		CarDarcID:     d.Car.GetBaseID(),
+		Status:        StatusExported,
+		Signers:       []darc.Identity{d.user.Identity()},
+	}
+	replyStatus, err := service.SetCarStatus(reqStatus)
+	require.Nil(t, err)
+	reqStatus.Signatures = signDigest(t, replyStatus.Digest, d.user)
+	_, err = service.SetCarStatus(reqStatus)
+	require.Nil(t, err)
+	replyVin, err = service.LookupVin(&LookupVin{ByzCoinID: bcID, Vin: reqCar.Car.Vin})
+	require.Nil(t, err)
+	require.Equal(t, StatusExported, replyVin.Status)
+}
+
+func TestDecryptEnvelope(t *testing.T) {
+	//only an ed25519 signer has the key to decrypt the envelope
+	_, err := DecryptEnvelope(&GetReportEnvelopeReply{}, darc.Signer{})
+	require.NotNil(t, err)
+}
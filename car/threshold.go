@@ -0,0 +1,126 @@
+package car
+
+/*
+The threshold.go lets a car have several owners, like a lessee and a leasing
+company, where M of the N owners must approve the transfer of the car and the
+reads they grant. The owner darc of such a car is spawned with
+SpawnOwnerDarc, where both its _sign and invoke:evolve rules are the
+ThresholdExpr of the owners. The rules of the car darc then point to the
+owner darc as for a single owner, so the car contract doesn't change: the
+instructions of the owner are only accepted with the signatures of M owners.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+)
+
+// MaxOwners is the biggest number of owners of a threshold owner darc, the
+// expression grows with the number of groups of owners reaching the
+// threshold.
+const MaxOwners = 8
+
+// ThresholdExpr returns the expression fulfilled by the signatures of at
+// least threshold of the identities, as the OR of all the groups of
+// threshold identities.
+func ThresholdExpr(threshold int, ids ...string) (expression.Expr, error) {
+	if len(ids) == 0 || len(ids) > MaxOwners {
+		return nil, fmt.Errorf("need between 1 and %d owners", MaxOwners)
+	}
+	if threshold < 1 || threshold > len(ids) {
+		return nil, errors.New("the threshold must be between 1 and the number of owners")
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			return nil, errors.New("the owners must be distinct identities")
+		}
+		seen[id] = true
+	}
+	if threshold == 1 {
+		return expression.InitOrExpr(ids...), nil
+	}
+	if threshold == len(ids) {
+		return expression.InitAndExpr(ids...), nil
+	}
+	var groups []string
+	for _, group := range combinations(ids, threshold) {
+		groups = append(groups, "("+string(expression.InitAndExpr(group...))+")")
+	}
+	return expression.InitOrExpr(groups...), nil
+}
+
+// combinations returns all the groups of k of the ids, keeping their order
+func combinations(ids []string, k int) [][]string {
+	if k == 0 {
+		return [][]string{{}}
+	}
+	var groups [][]string
+	for i := 0; i+k <= len(ids); i++ {
+		for _, rest := range combinations(ids[i+1:], k-1) {
+			groups = append(groups, append([]string{ids[i]}, rest...))
+		}
+	}
+	return groups
+}
+
+// SpawnOwnerDarc returns a transaction spawning the darc of the owners of a
+// car from an existing control darc, where threshold of the owner
+// identities must sign for the darc and to evolve it.
+func SpawnOwnerDarc(controlDarc *darc.Darc, owners []string, threshold int,
+	role string) (byzcoin.ClientTransaction, *darc.Darc, error) {
+
+	var ctx byzcoin.ClientTransaction
+	expr, err := ThresholdExpr(threshold, owners...)
+	if err != nil {
+		return ctx, nil, err
+	}
+	rs := darc.NewRules()
+	if err := rs.AddRule("invoke:evolve", expr); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	if err := rs.AddRule("_sign", expr); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
+	newDarc := darc.NewDarc(rs, []byte(role+" darc"))
+	newDarcBuf, err := newDarc.ToProto()
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx = newSpawnDarcTransaction(controlDarc, newDarcBuf)
+
+	return ctx, newDarc, err
+}
+
+// SetOwners evolves the owner darc so that threshold of the new owner
+// identities must sign for it, for example when the lessee of a car changes.
+// The signers must fulfil the current threshold of the darc, which is
+// returned after its evolution.
+func (c *Client) SetOwners(ownerDarc *darc.Darc, owners []string, threshold int,
+	signers ...darc.Signer) (*darc.Darc, error) {
+
+	expr, err := ThresholdExpr(threshold, owners...)
+	if err != nil {
+		return nil, err
+	}
+	newDarc := ownerDarc.Copy()
+	err = newDarc.EvolveFrom(ownerDarc)
+	if err != nil {
+		return nil, err
+	}
+	for _, action := range []darc.Action{"invoke:evolve", "_sign"} {
+		err = newDarc.Rules.UpdateRule(action, expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = c.EvolveDarc(newDarc, signers...)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetDarc(ownerDarc.GetBaseID())
+}
@@ -0,0 +1,39 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThresholdExpr(t *testing.T) {
+	expr, err := ThresholdExpr(1, "ed25519:a", "ed25519:b")
+	require.Nil(t, err)
+	require.Equal(t, expression.InitOrExpr("ed25519:a", "ed25519:b"), expr)
+	expr, err = ThresholdExpr(2, "ed25519:a", "ed25519:b")
+	require.Nil(t, err)
+	require.Equal(t, expression.InitAndExpr("ed25519:a", "ed25519:b"), expr)
+
+	//2 of 3 owners
+	expr, err = ThresholdExpr(2, "ed25519:a", "ed25519:b", "darc:c")
+	require.Nil(t, err)
+	require.Equal(t, expression.Expr("(ed25519:a & ed25519:b) | (ed25519:a & darc:c) | (ed25519:b & darc:c)"), expr)
+
+	//the threshold must be reachable by distinct owners
+	_, err = ThresholdExpr(0, "ed25519:a")
+	require.NotNil(t, err)
+	_, err = ThresholdExpr(3, "ed25519:a", "ed25519:b")
+	require.NotNil(t, err)
+	_, err = ThresholdExpr(2, "ed25519:a", "ed25519:a")
+	require.NotNil(t, err)
+	_, err = ThresholdExpr(1)
+	require.NotNil(t, err)
+	_, err = ThresholdExpr(1, "a", "b", "c", "d", "e", "f", "g", "h", "i")
+	require.NotNil(t, err)
+}
+
+func TestCombinations(t *testing.T) {
+	require.Equal(t, 10, len(combinations([]string{"a", "b", "c", "d", "e"}, 3)))
+	require.Equal(t, [][]string{{"a", "b"}, {"a", "c"}, {"b", "c"}}, combinations([]string{"a", "b", "c"}, 2))
+}
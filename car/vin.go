@@ -0,0 +1,140 @@
+package car
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/protobuf"
+)
+
+// ContractVinID is the contract of the registry entries linking a VIN to
+// its car instance. The entries are only created by the car contract.
+var ContractVinID = "carVin"
+
+// vinLength is the number of characters of a VIN as defined by ISO 3779
+const vinLength = 17
+
+// vinCheckIndex is the position of the check digit in the VIN
+const vinCheckIndex = 8
+
+// vinWeights are the weights of each position of the VIN in the check digit
+var vinWeights = [vinLength]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinValue transliterates a character of the VIN to its numerical value.
+// The letters I, O and Q are not allowed in a VIN.
+func vinValue(r byte) (int, error) {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0'), nil
+	case r >= 'A' && r <= 'H':
+		return int(r-'A') + 1, nil
+	case r >= 'J' && r <= 'N':
+		return int(r-'J') + 1, nil
+	case r == 'P':
+		return 7, nil
+	case r == 'R':
+		return 9, nil
+	case r >= 'S' && r <= 'Z':
+		return int(r-'S') + 2, nil
+	}
+	return 0, errors.New("invalid character in the VIN: " + string(r))
+}
+
+// VinCheckDigit returns the check digit of the VIN, computed over all the
+// other characters. The VIN must have 17 characters.
+func VinCheckDigit(vin string) (byte, error) {
+	if len(vin) != vinLength {
+		return 0, errors.New("a VIN must have 17 characters")
+	}
+	sum := 0
+	for i := 0; i < vinLength; i++ {
+		v, err := vinValue(vin[i])
+		if err != nil {
+			return 0, err
+		}
+		sum += v * vinWeights[i]
+	}
+	if sum%11 == 10 {
+		return 'X', nil
+	}
+	return byte('0' + sum%11), nil
+}
+
+// ValidateVin returns an error if the VIN is not made of 17 valid characters
+// or if its check digit is wrong.
+func ValidateVin(vin string) error {
+	check, err := VinCheckDigit(vin)
+	if err != nil {
+		return err
+	}
+	if vin[vinCheckIndex] != check {
+		return errors.New("wrong check digit in the VIN")
+	}
+	return nil
+}
+
+// NormalizeVin removes the surrounding spaces and puts the VIN in upper case.
+func NormalizeVin(vin string) string {
+	return strings.ToUpper(strings.TrimSpace(vin))
+}
+
+// VinInstanceID returns the ID of the registry entry of the VIN, which holds
+// the ID of the car instance with this VIN.
+func VinInstanceID(vin string) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractVinID))
+	h.Write([]byte(NormalizeVin(vin)))
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
+// VerifyVinProof checks that the proof comes from the ByzCoin ledger with
+// the given ID and that it holds the registry entry of the VIN. It returns
+// the entry and the ID of the darc controlling the car.
+func VerifyVinProof(proof *byzcoin.Proof, byzcoinID skipchain.SkipBlockID,
+	vin string) (*VinRecord, darc.ID, error) {
+
+	vinID := VinInstanceID(vin)
+	err := proof.Verify(byzcoinID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !proof.InclusionProof.Match(vinID.Slice()) {
+		return nil, nil, errors.New("no car registered with this VIN")
+	}
+	_, value, contractID, darcID, err := proof.KeyValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if contractID != ContractVinID {
+		return nil, nil, errors.New("not a VIN registry entry")
+	}
+	var record VinRecord
+	err = protobuf.Decode(value, &record)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Vin != NormalizeVin(vin) {
+		return nil, nil, errors.New("the registry entry is for another VIN")
+	}
+	return &record, darcID, nil
+}
+
+// LookupVin returns the ID of the car instance with the VIN and the ID of
+// the car darc, after verifying the proof of the registry entry, which is
+// also returned.
+func (c *Client) LookupVin(vin string) (byzcoin.InstanceID, darc.ID, *byzcoin.Proof, error) {
+	var instID byzcoin.InstanceID
+	resp, err := c.ByzCoin.GetProof(VinInstanceID(vin).Slice())
+	if err != nil {
+		return instID, nil, nil, err
+	}
+	record, darcID, err := VerifyVinProof(&resp.Proof, c.ByzCoin.ID, vin)
+	if err != nil {
+		return instID, nil, nil, err
+	}
+	return byzcoin.NewInstanceID(record.CarInstanceID), darcID, &resp.Proof, nil
+}
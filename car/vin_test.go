@@ -0,0 +1,22 @@
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateVin(t *testing.T) {
+	for _, vin := range []string{"1HGCM82633A004352", "1M8GDM9AXKP042788", "11111111111111111"} {
+		require.Nil(t, ValidateVin(vin), vin)
+	}
+	for _, vin := range []string{"", "123A2314", "1HGCM82643A004352", "1HGCM82633A00435O", "1hgcm82633a004352"} {
+		require.NotNil(t, ValidateVin(vin), vin)
+	}
+	require.Nil(t, ValidateVin(NormalizeVin(" 1hgcm82633a004352 ")))
+}
+
+func TestVinInstanceID(t *testing.T) {
+	require.Equal(t, VinInstanceID("1HGCM82633A004352"), VinInstanceID(" 1hgcm82633a004352"))
+	require.NotEqual(t, VinInstanceID("1HGCM82633A004352"), VinInstanceID("1M8GDM9AXKP042788"))
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/calypso"
@@ -73,6 +74,9 @@ func spawnCarDarc(controlDarc *darc.Darc,
 	if err := rs.AddRule("spawn:calypsoWrite", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
 		panic("add rule should never fail on an empty rule list: " + err.Error())
 	}
+	if err := rs.AddRule("invoke:transferOwnership", expression.InitAndExpr(darcOwner.GetIdentityString())); err != nil {
+		panic("add rule should never fail on an empty rule list: " + err.Error())
+	}
 
 	//todo will it cause problems to create many car darcs with same rules and description? this is why i added ID
 	darcCar := darc.NewDarc(rs,
@@ -94,6 +98,17 @@ func spawnCarDarc(controlDarc *darc.Darc,
 	return inst, darcCar, err
 }
 
+//returns a valid and unique VIN for the simulated car with the given id
+func newVin(id int) string {
+	vin := []byte(fmt.Sprintf("1HGCM826X3A%06d", id))
+	check, err := car.VinCheckDigit(string(vin))
+	if err != nil {
+		panic("the VIN template should always be valid: " + err.Error())
+	}
+	vin[8] = check
+	return string(vin)
+}
+
 //creating transaction with spawn:car instruction
 func createCarInstanceInstr(car car.Car,
 	controlDarc *darc.Darc) (byzcoin.Instruction, error) {
@@ -122,7 +137,7 @@ func addWrite(key []byte, wData car.SecretData,
 	write := calypso.NewWrite(cothority.Suite, lts.LTSID, controlDarc.GetBaseID(), lts.X, key)
 	var err error
 
-	writeDataBuf, err := protobuf.Encode(&wData)
+	writeDataBuf, err := car.EncodeSecretData(&wData)
 	if err != nil {
 		return instr, err
 	}
@@ -152,14 +167,16 @@ func addWrite(key []byte, wData car.SecretData,
 
 
 
+//newReport holds the mileage commitment and proof of the report
 func addReport(carInstID byzcoin.InstanceID, writeInstanceID byzcoin.InstanceID,
-	signer darc.Signer) (byzcoin.Instruction, error){
+	newReport car.Report, carDarc *darc.Darc, signer darc.Signer) (byzcoin.Instruction, error){
 	var instr byzcoin.Instruction
-	//creating new Report to be added in the list of the reports in the instance
-	var newReport car.Report
-	newReport.Date = time.Now().String()
+	//completing the Report to be added in the list of the reports in the instance
+	newReport.Timestamp = time.Now().UnixNano()
 	newReport.WriteInstanceID = writeInstanceID.Slice()
-	newReport.GarageId = signer.Identity().String()
+	newReport.GarageId = string(carDarc.Rules.Get("invoke:addReport"))
+	newReport.SignedBy = signer.Identity().String()
+	newReport.Kind = car.ReportService
 
 	reportBuf, err := protobuf.Encode(&newReport)
 	if err != nil {
@@ -14,7 +14,6 @@ import (
 	"github.com/dedis/onet/simul/monitor"
 	"github.com/dedis/protobuf"
 	"github.com/dedis/student_18_car/car"
-	"strconv"
 	"time"
 )
 
@@ -80,11 +79,11 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	var carDarcs []darc.Darc
 	var carInstances []byzcoin.InstanceID
 	var writeInstances []byzcoin.InstanceID
+	var reports []car.Report
 	var readInstances []byzcoin.InstanceID
 	//we'll use the following secret data for every report, for simplicity
-	var wData car.SecretData
-	wData.ECOScore = "2310"
-	wData.Mileage = "100 000"
+	wData := car.NewSecretData(car.ReportService, 100000, car.Kilometers)
+	wData.ECOScore = 2310
 	wData.Warranty = true
 
 	// Measuring the time it takes to setup the blockchain
@@ -95,7 +94,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 
 	// Create the ledger
 	gm, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, config.Roster,
-		[]string{"spawn:darc"}, signer.Identity())
+		[]string{"spawn:darc", "spawn:garageRegistry", "invoke:certifyGarage"}, signer.Identity())
 	if err != nil {
 		return errors.New("couldn't setup genesis message: " + err.Error())
 	}
@@ -161,6 +160,23 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 		return errors.New("couldn't create user darc: " + err.Error())
 	}
 
+	// The user darc is the garage of all the cars, it has to be certified
+	carClient := car.NewClientFromByzCoin(c)
+	err = carClient.CreateGarageRegistry(&gm.GenesisDarc, gm.GenesisDarc.GetBaseID(), signer)
+	if err != nil {
+		return errors.New("couldn't create garage registry: " + err.Error())
+	}
+	err = carClient.CertifyGarage(&gm.GenesisDarc, car.CertifiedGarage{
+		GarageDarcID: userDarc.GetBaseID(),
+		Name:         "Simulation garage",
+		Licence:      "simulation",
+		ValidFrom:    time.Now().Add(-time.Hour).Unix(),
+		ValidUntil:   time.Now().Add(24 * time.Hour).Unix(),
+	}, signer)
+	if err != nil {
+		return errors.New("couldn't certify garage: " + err.Error())
+	}
+
 
 
 
@@ -228,7 +244,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 		}
 		for i := 0; i < insts; i++ {
 			counterID++
-			c := car.NewCar(strconv.Itoa(counterID))
+			c := car.NewCar(newVin(counterID))
 			instr, err := createCarInstanceInstr(c, &carDarcs[t*insts+i])
 			if err != nil {
 				return errors.New("instruction error: " + err.Error())
@@ -279,8 +295,16 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 			tx.Instructions = byzcoin.Instructions{}
 		}
 		for i := 0; i < insts; i++ {
+			//every write holds its own blinding factor of the mileage commitment
+			var report car.Report
+			secret := wData
+			err = report.CommitMileage(&secret, nil)
+			if err != nil {
+				return errors.New("mileage commitment error: " + err.Error())
+			}
+			reports = append(reports, report)
 			key := random.Bits(128, true, random.New())
-			instr, err := addWrite(key, wData,
+			instr, err := addWrite(key, secret,
 				&carDarcs[t*insts+i], *lts)
 			if err != nil {
 				return errors.New("instruction error: " + err.Error())
@@ -323,7 +347,8 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 			tx.Instructions = byzcoin.Instructions{}
 		}
 		for i := 0; i < insts; i++ {
-			instruction, err := addReport(carInstances[t*insts+i], writeInstances[t*insts+i], user)
+			instruction, err := addReport(carInstances[t*insts+i], writeInstances[t*insts+i],
+				reports[t*insts+i], &carDarcs[t*insts+i], user)
 			if err != nil {
 				return errors.New("instruction error: " + err.Error())
 			}
@@ -379,9 +404,22 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 			if err != nil {
 				return err
 			}
-			//get the proof for the write instance
-			if (len(carData.Reports)>0){
-				resp, err = c.GetProof(carData.Reports[0].WriteInstanceID)
+			//get the proof for the write instance of the first report
+			if (carData.ReportCount>0){
+				resp, err = c.GetProof(car.ReportInstanceID(carInstances[t*insts+i], 0).Slice())
+				if err != nil {
+					return err
+				}
+				_, values, _, _, err = resp.Proof.KeyValue()
+				if err != nil {
+					return err
+				}
+				var report car.Report
+				err = protobuf.Decode(values, &report)
+				if err != nil {
+					return err
+				}
+				resp, err = c.GetProof(report.WriteInstanceID)
 				if err != nil {
 					return err
 				}
@@ -452,8 +490,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 
 		//decrypting the secret and placing it in a SecretData structure
 		plainText, err := decrypt(write.Data, key)
-		var secret car.SecretData
-		err = protobuf.Decode(plainText, &secret)
+		_, err = car.DecodeSecretData(plainText)
 		if err != nil {
 			return err
 		}